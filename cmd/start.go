@@ -13,6 +13,10 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var adminAddr string
+var traceExporter string
+var otlpEndpoint string
+
 var startCmd = &cobra.Command{
 	Use: "start",
 	Run: func(cmd *cobra.Command, args []string) {
@@ -20,8 +24,17 @@ var startCmd = &cobra.Command{
 	},
 }
 
+func init() {
+	startCmd.Flags().StringVar(&adminAddr, "admin-addr", "127.0.0.1:9091", "admin api listen address, the api is disabled when adminToken is not set in config")
+	startCmd.Flags().StringVar(&traceExporter, "trace-exporter", "", "opentelemetry trace exporter, support otlp, stdout, or leave empty to disable tracing")
+	startCmd.Flags().StringVar(&core.LogFlags.Level, "log-level", "", "log level, overrides the level in config file")
+	startCmd.Flags().StringVar(&core.LogFlags.Format, "log-format", "", "log format, text or json, overrides the format in config file")
+	startCmd.Flags().StringVar(&core.LogFlags.File, "log-file", "", "log file path, rotated by the size set in config file, default to stdout")
+	startCmd.Flags().StringVar(&otlpEndpoint, "otlp-endpoint", "", "otlp http endpoint url, default to OTEL_EXPORTER_OTLP_ENDPOINT or http://localhost:4318")
+}
+
 func waitExitSignal(ctxStop context.CancelFunc) {
-	var exitSignal = make(chan os.Signal)
+	var exitSignal = make(chan os.Signal, 1)
 	signal.Notify(exitSignal, syscall.SIGTERM)
 	signal.Notify(exitSignal, syscall.SIGINT)
 
@@ -33,13 +46,32 @@ func waitExitSignal(ctxStop context.CancelFunc) {
 
 func Run() int {
 
+	if err := core.ApplyLogConfig(core.LogConfig{}); err != nil {
+		logrus.Fatal(err)
+	}
+
 	ctx, stop := context.WithCancel(context.Background())
 	go waitExitSignal(stop)
 
+	if traceExporter != "" {
+		shutdownTracing, err := core.InitTracing(ctx, traceExporter, otlpEndpoint)
+
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		defer func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = shutdownTracing(shutdownCtx)
+		}()
+	}
+
 	quitLoopConfig := make(chan bool)
 	core.LoadConfig(ctx, quitLoopConfig)
 
 	go core.StartMonitorHttpServer(ctx)
+	go core.StartAdminHttpServer(ctx, adminAddr)
 	httpServer := &http.Server{Addr: ":3005", Handler: &core.Server{}}
 
 	// http server graceful shutdown
@@ -0,0 +1,129 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/HydroProtocol/ethereum-jsonrpc-gateway/utils"
+	"github.com/sirupsen/logrus"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+var requestIDPattern = regexp.MustCompile(`^[a-zA-Z0-9._:-]{1,128}$`)
+
+// accessLogger writes one json line for every client request
+var accessLogger = &logrus.Logger{
+	Out:       os.Stdout,
+	Formatter: &logrus.JSONFormatter{},
+	Hooks:     make(logrus.LevelHooks),
+	Level:     logrus.InfoLevel,
+}
+
+type accessLogEntry struct {
+	transport string
+	clientIP  string
+	forwarded string
+	apiKey    string
+	request   *Request
+	status    int
+	startAt   time.Time
+	bytes     int
+	err       error
+}
+
+// requestID returns the id sent by client in X-Request-ID header, or a new random one
+func requestID(req *http.Request) string {
+	if req != nil {
+		if id := req.Header.Get(requestIDHeader); requestIDPattern.MatchString(id) {
+			return id
+		}
+	}
+
+	return utils.RandStringRunes(8)
+}
+
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+func clientAPIKey(req *http.Request) string {
+	if key := req.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+
+	return req.URL.Query().Get("apiKey")
+}
+
+// api keys are credentials, only show the beginning and the end of them
+func maskAPIKey(key string) string {
+	if key == "" {
+		return ""
+	}
+
+	if len(key) <= 8 {
+		return "***"
+	}
+
+	return key[:4] + "***" + key[len(key)-4:]
+}
+
+func paramsHash(params []interface{}) string {
+	bts, _ := json.Marshal(params)
+	sum := sha256.Sum256(bts)
+	return hex.EncodeToString(sum[:8])
+}
+
+func newAccessLogEntry(transport string, req *http.Request) *accessLogEntry {
+	return &accessLogEntry{
+		transport: transport,
+		clientIP:  clientIP(req),
+		forwarded: req.Header.Get("X-Forwarded-For"),
+		apiKey:    maskAPIKey(clientAPIKey(req)),
+		startAt:   time.Now(),
+	}
+}
+
+func (e *accessLogEntry) write() {
+	fields := logrus.Fields{
+		"transport":  e.transport,
+		"client_ip":  e.clientIP,
+		"status":     e.status,
+		"latency_ms": float64(time.Since(e.startAt)) / float64(time.Millisecond),
+		"bytes":      e.bytes,
+	}
+
+	if e.forwarded != "" {
+		fields["forwarded_for"] = e.forwarded
+	}
+
+	if e.apiKey != "" {
+		fields["api_key"] = e.apiKey
+	}
+
+	if e.request != nil {
+		fields["request_id"] = e.request.id
+		fields["method"] = e.request.data.Method
+		fields["params_hash"] = paramsHash(e.request.data.Params)
+		fields["upstream"] = e.request.upstream
+		fields["archive"] = e.request.isArchiveDataRequest
+	}
+
+	if e.err != nil {
+		fields["error"] = e.err.Error()
+	}
+
+	accessLogger.WithFields(fields).Info("access")
+}
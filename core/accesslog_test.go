@@ -0,0 +1,71 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestID(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	assert.Equal(t, 8, len(requestID(req)))
+
+	req.Header.Set(requestIDHeader, "abc-123")
+	assert.Equal(t, "abc-123", requestID(req))
+
+	req.Header.Set(requestIDHeader, "abc 123\n")
+	assert.NotEqual(t, "abc 123\n", requestID(req))
+}
+
+func TestMaskAPIKey(t *testing.T) {
+	assert.Equal(t, "", maskAPIKey(""))
+	assert.Equal(t, "***", maskAPIKey("short"))
+	assert.Equal(t, "8343***9707", maskAPIKey("83438c4dcf834ceb8944162688749707"))
+}
+
+func TestParamsHash(t *testing.T) {
+	assert.Equal(t, paramsHash([]interface{}{"0x1", "latest"}), paramsHash([]interface{}{"0x1", "latest"}))
+	assert.NotEqual(t, paramsHash([]interface{}{"0x1", "latest"}), paramsHash([]interface{}{"0x2", "latest"}))
+}
+
+func TestServeHTTPAccessLog(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer upstream.Close()
+
+	buildTestConfig("NAIVE", upstream.URL)
+
+	var buf bytes.Buffer
+	accessLogger.Out = &buf
+	defer func() { accessLogger.Out = os.Stdout }()
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"params": [], "method": "eth_blockNumber", "id": 1, "jsonrpc": "2.0"}`))
+	req.Header.Set(requestIDHeader, "client-id-1")
+	req.Header.Set("X-API-Key", "83438c4dcf834ceb8944162688749707")
+
+	w := httptest.NewRecorder()
+	(&Server{}).ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "client-id-1", w.Header().Get(requestIDHeader))
+
+	var line map[string]interface{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &line))
+
+	assert.Equal(t, "client-id-1", line["request_id"])
+	assert.Equal(t, "eth_blockNumber", line["method"])
+	assert.Equal(t, "8343***9707", line["api_key"])
+	assert.Equal(t, float64(200), line["status"])
+	assert.Equal(t, float64(w.Body.Len()), line["bytes"])
+	assert.Equal(t, upstream.URL, line["upstream"])
+	assert.Equal(t, false, line["archive"])
+}
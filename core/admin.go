@@ -0,0 +1,333 @@
+package core
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// AdminServer exposes the runtime state of the gateway and allows operators
+// to control upstreams and strategy without editing the config file
+type AdminServer struct{}
+
+type adminUpstreamInfo struct {
+	Index       int     `json:"index"`
+	Name        string  `json:"name"`
+	Url         string  `json:"url"`
+	Status      string  `json:"status"`
+	Circuit     string  `json:"circuit"`
+	RateLimited bool    `json:"rateLimited"`
+	Lagging     bool    `json:"lagging"`
+	Healthy     bool    `json:"healthy"`
+	BlockNumber int64   `json:"blockNumber"`
+	LatencyMs   float64 `json:"latencyMs"`
+	InFlight    int64   `json:"inFlight"`
+}
+
+type adminUpstreamsResponse struct {
+	Strategy         string              `json:"strategy"`
+	CurrentIndex     *int                `json:"currentIndex,omitempty"`
+	Upstreams        []adminUpstreamInfo `json:"upstreams"`
+	ArchiveUpstreams []adminUpstreamInfo `json:"archiveUpstreams,omitempty"`
+}
+
+func adminUpstreamInfos(upstreams []Upstream) []adminUpstreamInfo {
+	infos := make([]adminUpstreamInfo, 0, len(upstreams))
+
+	for i, upstream := range upstreams {
+		s := upstream.state()
+
+		infos = append(infos, adminUpstreamInfo{
+			Index:       i,
+			Name:        s.name,
+			Url:         redactUrl(s.url),
+			Status:      s.statusText(),
+			Circuit:     s.breaker.stateText(),
+			RateLimited: s.isRateLimited(),
+			Lagging:     s.isLagging(),
+			Healthy:     s.isHealthy(),
+			BlockNumber: atomic.LoadInt64(&s.blockNumber),
+			LatencyMs:   float64(atomic.LoadInt64(&s.latency)) / float64(time.Millisecond),
+			InFlight:    atomic.LoadInt64(&s.inFlight),
+		})
+	}
+
+	return infos
+}
+
+type adminStrategyRequest struct {
+	Strategy string `json:"strategy"`
+}
+
+func writeAdminResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	writeAdminResponse(w, status, map[string]string{"error": message})
+}
+
+func (h *AdminServer) authorized(req *http.Request) bool {
+	token := currentRunningConfig().config.AdminToken
+
+	if token == "" {
+		return false
+	}
+
+	auth := req.Header.Get("Authorization")
+
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
+func (h *AdminServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if currentRunningConfig() == nil {
+		writeAdminError(w, http.StatusServiceUnavailable, "config not loaded")
+		return
+	}
+
+	if !h.authorized(req) {
+		writeAdminError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	path := strings.Trim(req.URL.Path, "/")
+
+	switch {
+	case path == "config" && req.Method == http.MethodGet:
+		h.getConfig(w)
+	case path == "upstreams" && req.Method == http.MethodGet:
+		h.getUpstreams(w)
+	case strings.HasPrefix(path, "upstreams/") && req.Method == http.MethodPost:
+		h.updateUpstream(w, strings.TrimPrefix(path, "upstreams/"))
+	case path == "strategy" && req.Method == http.MethodPost:
+		h.updateStrategy(w, req)
+	case path == "transactions" && req.Method == http.MethodGet:
+		h.getTransactions(w, req)
+	case strings.HasPrefix(path, "transactions/") && req.Method == http.MethodGet:
+		h.getTransaction(w, strings.TrimPrefix(path, "transactions/"))
+	default:
+		writeAdminError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (h *AdminServer) getConfig(w http.ResponseWriter) {
+	rcfg := currentRunningConfig()
+	cfg := *rcfg.config
+	cfg.AdminToken = ""
+	cfg.Strategy, _ = rcfg.getStrategy()
+
+	if cfg.OldTrieUrl != "" {
+		cfg.OldTrieUrl = redactUrl(cfg.OldTrieUrl)
+	}
+
+	cfg.Upstreams = redactUpstreams(cfg.Upstreams)
+	cfg.Archive.Upstreams = redactUpstreams(cfg.Archive.Upstreams)
+	cfg.Broadcast.SendOnlyUpstreams = redactUpstreams(cfg.Broadcast.SendOnlyUpstreams)
+
+	writeAdminResponse(w, http.StatusOK, cfg)
+}
+
+// redactUrl hides the userinfo, path and query of an upstream url, providers put api keys in them
+func redactUrl(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+
+	if err != nil {
+		return "***"
+	}
+
+	redacted := u.Scheme + "://"
+
+	if u.User != nil {
+		redacted += "***@"
+	}
+
+	redacted += u.Host
+
+	if strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+		redacted += "/***"
+	}
+
+	return redacted
+}
+
+// redactUpstreams hides the url credentials, header values and auth credentials of the upstreams
+func redactUpstreams(upstreams []*UpstreamConfig) []*UpstreamConfig {
+	redacted := make([]*UpstreamConfig, 0, len(upstreams))
+
+	for _, upstream := range upstreams {
+		c := *upstream
+		c.Url = redactUrl(c.Url)
+
+		if len(c.Headers) > 0 {
+			c.Headers = make(map[string]string, len(upstream.Headers))
+
+			for k := range upstream.Headers {
+				c.Headers[k] = "***"
+			}
+		}
+
+		if c.Auth != nil {
+			auth := *c.Auth
+
+			if auth.Password != "" {
+				auth.Password = "***"
+			}
+
+			if auth.BearerToken != "" {
+				auth.BearerToken = "***"
+			}
+
+			c.Auth = &auth
+		}
+
+		redacted = append(redacted, &c)
+	}
+
+	return redacted
+}
+
+func (h *AdminServer) getUpstreams(w http.ResponseWriter) {
+	rcfg := currentRunningConfig()
+	name, strategy := rcfg.getStrategy()
+
+	res := adminUpstreamsResponse{
+		Strategy: name,
+	}
+
+	if p, ok := strategy.(*FallbackProxy); ok {
+		index := p.currentUpstreamIndex.Load().(int)
+		res.CurrentIndex = &index
+	}
+
+	res.Upstreams = adminUpstreamInfos(rcfg.Upstreams)
+
+	if archive := rcfg.archive; archive != nil {
+		res.ArchiveUpstreams = adminUpstreamInfos(archive.upstreams)
+	}
+
+	writeAdminResponse(w, http.StatusOK, res)
+}
+
+// path is in "{index}/{action}" format, action can be enable, disable or drain
+func (h *AdminServer) updateUpstream(w http.ResponseWriter, path string) {
+	parts := strings.Split(path, "/")
+
+	if len(parts) != 2 {
+		writeAdminError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	rcfg := currentRunningConfig()
+	index, err := strconv.Atoi(parts[0])
+
+	if err != nil || index < 0 || index >= len(rcfg.Upstreams) {
+		writeAdminError(w, http.StatusBadRequest, "invalid upstream index")
+		return
+	}
+
+	var status int32
+
+	switch parts[1] {
+	case "enable":
+		status = upstreamEnabled
+	case "disable":
+		status = upstreamDisabled
+	case "drain":
+		status = upstreamDraining
+	default:
+		writeAdminError(w, http.StatusBadRequest, "unknown action: "+parts[1])
+		return
+	}
+
+	s := rcfg.Upstreams[index].state()
+	s.setStatus(status)
+
+	adminLog.Infof("admin: upstream %d %s", index, parts[1])
+
+	writeAdminResponse(w, http.StatusOK, map[string]interface{}{"index": index, "status": s.statusText()})
+}
+
+func (h *AdminServer) updateStrategy(w http.ResponseWriter, req *http.Request) {
+	var body adminStrategyRequest
+
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "invalid body")
+		return
+	}
+
+	if err := currentRunningConfig().switchStrategy(body.Strategy); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	adminLog.Infof("admin: switch strategy to %s", body.Strategy)
+
+	writeAdminResponse(w, http.StatusOK, map[string]string{"strategy": body.Strategy})
+}
+
+func (h *AdminServer) getTransactions(w http.ResponseWriter, req *http.Request) {
+	tracker := currentRunningConfig().txTracker
+
+	if tracker == nil {
+		writeAdminError(w, http.StatusNotFound, "transaction tracker is disabled")
+		return
+	}
+
+	writeAdminResponse(w, http.StatusOK, map[string]interface{}{"transactions": tracker.list(req.URL.Query().Get("status"))})
+}
+
+func (h *AdminServer) getTransaction(w http.ResponseWriter, hash string) {
+	tracker := currentRunningConfig().txTracker
+
+	if tracker == nil {
+		writeAdminError(w, http.StatusNotFound, "transaction tracker is disabled")
+		return
+	}
+
+	tx, exist := tracker.get(hash)
+
+	if !exist {
+		writeAdminError(w, http.StatusNotFound, "transaction not tracked")
+		return
+	}
+
+	writeAdminResponse(w, http.StatusOK, tx)
+}
+
+func StartAdminHttpServer(ctx context.Context, addr string) {
+	hs := &http.Server{
+		Addr:    addr,
+		Handler: &AdminServer{},
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := hs.Shutdown(shutdownCtx); err != nil {
+			adminLog.Fatalf("Could not gracefully shutdown admin server: %v\n", err)
+		}
+	}()
+
+	adminLog.Infof("admin server listen on %s", addr)
+
+	if err := hs.ListenAndServe(); err != nil {
+		if err != http.ErrServerClosed {
+			adminLog.Errorf("Listen failed %v", err)
+		}
+	}
+}
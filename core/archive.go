@@ -0,0 +1,147 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ArchiveConfig decides which requests read state only archive nodes keep, and where they go
+type ArchiveConfig struct {
+	// state older than this many blocks is archive data, it should match the pruning depth of the full nodes
+	BlockThreshold int `json:"blockThreshold,omitempty"`
+	// archive nodes serving archive data requests, instead of oldTrieUrl
+	Upstreams []*UpstreamConfig `json:"upstreams,omitempty"`
+	// FALLBACK or RACE, the default is FALLBACK
+	Strategy string `json:"strategy,omitempty"`
+}
+
+const defaultArchiveBlockThreshold = 100
+
+// errors of full nodes which pruned the state of the requested block
+var archiveErrorMessages = []string{
+	"missing trie node",
+	"historical state",
+	"state is not available",
+}
+
+// index of the block param of methods reading the state at a block
+var stateAtBlockMethods = map[string]int{
+	"eth_getBalance":          1,
+	"eth_getCode":             1,
+	"eth_getTransactionCount": 1,
+	"eth_getStorageAt":        2,
+	"eth_getProof":            2,
+	"eth_call":                1,
+	"eth_estimateGas":         1,
+	"debug_traceCall":         1,
+}
+
+// a block hash is 32 bytes
+const blockHashLength = 2 + 64
+
+// isArchiveBlockParam tells whether the state at the block param may be pruned by full nodes.
+// The param is a block number, a tag, a block hash or an EIP-1898 object.
+// The depth of a block hash is unknown, so it's served by archive nodes.
+func isArchiveBlockParam(param interface{}, currentBlockNumber, threshold int) bool {
+	switch v := param.(type) {
+	case string:
+		switch v {
+		case "", "latest", "pending", "safe", "finalized":
+			return false
+		case "earliest":
+			return true
+		}
+
+		if len(v) == blockHashLength && strings.HasPrefix(v, "0x") {
+			return true
+		}
+
+		n, err := strconv.ParseInt(v, 0, 64)
+
+		if err != nil {
+			return false
+		}
+
+		return isArchiveBlockNumber(int(n), currentBlockNumber, threshold)
+	case float64:
+		return isArchiveBlockNumber(int(v), currentBlockNumber, threshold)
+	case int:
+		return isArchiveBlockNumber(v, currentBlockNumber, threshold)
+	case map[string]interface{}:
+		if hash, ok := v["blockHash"].(string); ok && hash != "" {
+			return true
+		}
+
+		if number, ok := v["blockNumber"]; ok {
+			return isArchiveBlockParam(number, currentBlockNumber, threshold)
+		}
+
+		return false
+	default:
+		return false
+	}
+}
+
+// the head is unknown if currentBlockNumber is 0
+func isArchiveBlockNumber(n, currentBlockNumber, threshold int) bool {
+	return currentBlockNumber > 0 && currentBlockNumber-n > threshold
+}
+
+// archiveRouter sends archive data requests to the archive upstreams with their own strategy
+type archiveRouter struct {
+	upstreams []Upstream
+	strategy  IStrategy
+	heads     *headTracker // checks the archive upstreams
+}
+
+func newArchiveRouter(ctx context.Context, cfg *Config, upstreams []*UpstreamConfig) (*archiveRouter, error) {
+	a := &archiveRouter{}
+
+	for _, upstreamConfig := range upstreams {
+		if upstreamConfig.CircuitBreaker == nil {
+			upstreamConfig.CircuitBreaker = &cfg.CircuitBreaker
+		}
+
+		a.upstreams = append(a.upstreams, newUpstream(ctx, upstreamConfig.Url, upstreamConfig))
+	}
+
+	switch cfg.Archive.Strategy {
+	case "", "FALLBACK":
+		p := newFallbackProxy()
+		p.upstreams = a.upstreams
+		a.strategy = p
+	case "RACE":
+		a.strategy = &RaceProxy{upstreams: a.upstreams}
+	default:
+		return nil, fmt.Errorf("unsupported archive strategy: %s", cfg.Archive.Strategy)
+	}
+
+	a.heads = newHeadTracker(ctx, &cfg.HeadTracker, a.upstreams)
+
+	return a, nil
+}
+
+// handle sends archive data requests to the archive upstreams, other requests are proxied by next.
+// A request is sent to the archive upstreams again if a full node has pruned the state it reads.
+func (a *archiveRouter) handle(ctx context.Context, req *Request, next requestHandler) ([]byte, error) {
+	rcfg := currentRunningConfig()
+
+	if req.isOldTrieRequest(int(rcfg.heads.head()), rcfg.archiveBlockThreshold) {
+		archiveRequestsTotal.WithLabelValues("block").Inc()
+		return a.strategy.handle(ctx, req)
+	}
+
+	bts, err := next(ctx, req)
+
+	if err != nil || ctx.Err() != nil || !rpcErrorMessageContains(bts, archiveErrorMessages) {
+		return bts, err
+	}
+
+	req.logger.Debugf("upstream %s has pruned the state, send to archive upstreams", req.upstream)
+	req.isArchiveDataRequest = true
+	archiveRequestsTotal.WithLabelValues("pruned").Inc()
+
+	return a.strategy.handle(ctx, req)
+}
@@ -0,0 +1,192 @@
+package core
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsArchiveBlockParam(t *testing.T) {
+	hash := "0x88e96d4537bea4d9c05d12549907b32561d3bf31f45aae734cdc119f13406cb6"
+
+	cases := []struct {
+		param    interface{}
+		head     int
+		expected bool
+	}{
+		{"latest", 10000, false},
+		{"pending", 10000, false},
+		{"safe", 10000, false},
+		{"finalized", 10000, false},
+		{"earliest", 10000, true},
+		{"earliest", 0, true},
+		{"0x2710", 10000, false},
+		{"0x1", 10000, true},
+		{"0x1", 0, false},
+		{"1", 10000, true},
+		{float64(9950), 10000, false},
+		{float64(9899), 10000, true},
+		{hash, 10000, true},
+		{map[string]interface{}{"blockHash": hash, "requireCanonical": true}, 10000, true},
+		{map[string]interface{}{"blockNumber": "0x1"}, 10000, true},
+		{map[string]interface{}{"blockNumber": "latest"}, 10000, false},
+		{map[string]interface{}{}, 10000, false},
+		{"not a block", 10000, false},
+		{nil, 10000, false},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, isArchiveBlockParam(c.param, c.head, 100), "%v at %d", c.param, c.head)
+	}
+}
+
+func TestIsOldTrieRequestMethods(t *testing.T) {
+	buildTestConfig("NAIVE", "http://test1.com")
+
+	cases := []struct {
+		body     string
+		expected bool
+	}{
+		{`{"params": ["0x01", "0x1"], "method": "eth_getCode", "id": 1, "jsonrpc": "2.0"}`, true},
+		{`{"params": ["0x01", "0x0", "0x1"], "method": "eth_getStorageAt", "id": 1, "jsonrpc": "2.0"}`, true},
+		{`{"params": ["0x01", "0x1"], "method": "eth_getStorageAt", "id": 1, "jsonrpc": "2.0"}`, false},
+		{`{"params": ["0x01", "earliest"], "method": "eth_getTransactionCount", "id": 1, "jsonrpc": "2.0"}`, true},
+		{`{"params": ["0x01", [], {"blockNumber": "0x1"}], "method": "eth_getProof", "id": 1, "jsonrpc": "2.0"}`, true},
+		{`{"params": [{"to": "0x01"}], "method": "eth_estimateGas", "id": 1, "jsonrpc": "2.0"}`, false},
+		{`{"params": [{"to": "0x01"}, "0x1"], "method": "eth_estimateGas", "id": 1, "jsonrpc": "2.0"}`, true},
+		{`{"params": [{"to": "0x01"}, "0x1", {}], "method": "eth_call", "id": 1, "jsonrpc": "2.0"}`, true},
+		{`{"params": [{"to": "0x01"}, "0x1", {"tracer": "callTracer"}], "method": "debug_traceCall", "id": 1, "jsonrpc": "2.0"}`, true},
+		{`{"params": ["0x1", false], "method": "eth_getBlockByNumber", "id": 1, "jsonrpc": "2.0"}`, false},
+	}
+
+	for _, c := range cases {
+		req, _ := newRequest([]byte(c.body))
+		assert.Equal(t, c.expected, req.isOldTrieRequest(10000, 100), c.body)
+		assert.Equal(t, c.expected, req.isArchiveDataRequest, c.body)
+	}
+}
+
+func TestArchiveRouter(t *testing.T) {
+	var fullCalls, archiveCalls1, archiveCalls2 int32
+
+	full := newBodyTestServer(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"missing trie node 1a2b (path )"}}`, &fullCalls)
+	defer full.Close()
+
+	archiveResults := map[string]string{"eth_blockNumber": `"0x2710"`, "eth_getBalance": `"0x1"`}
+
+	archive1 := newMethodTestServer(archiveResults, &archiveCalls1)
+	defer archive1.Close()
+
+	archive2 := newMethodTestServer(archiveResults, &archiveCalls2)
+	defer archive2.Close()
+
+	config := &Config{
+		Strategy:  "NAIVE",
+		Upstreams: []*UpstreamConfig{{Url: full.URL}},
+		Archive: ArchiveConfig{
+			Upstreams: []*UpstreamConfig{{Url: archive1.URL}, {Url: archive2.URL}},
+		},
+	}
+
+	rcfg, err := BuildRunningConfigFromConfig(context.Background(), config)
+	assert.Nil(t, err)
+
+	// the full node answers nothing but errors, its head is set by hand
+	rcfg.Upstreams[0].state().setHead(10000)
+	rcfg.archive.heads.poll(context.Background())
+	assert.Equal(t, int64(10000), rcfg.archive.heads.head())
+
+	// old blocks go to the archive upstreams directly
+	req, _ := newRequest([]byte(`{"params": ["0x01", "0x1"], "method": "eth_getBalance", "id": 1, "jsonrpc": "2.0"}`))
+	_, bts, err := dispatch(context.Background(), req)
+
+	assert.Nil(t, err)
+	assert.Contains(t, string(bts), `"0x1"`)
+	assert.Equal(t, archive1.URL, req.upstream)
+	assert.True(t, req.isArchiveDataRequest)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&fullCalls))
+
+	// the full node has pruned the state
+	req, _ = newRequest([]byte(`{"params": ["0x01", "latest"], "method": "eth_getBalance", "id": 1, "jsonrpc": "2.0"}`))
+	_, bts, err = dispatch(context.Background(), req)
+
+	assert.Nil(t, err)
+	assert.Contains(t, string(bts), `"0x1"`)
+	assert.Equal(t, archive1.URL, req.upstream)
+	assert.True(t, req.isArchiveDataRequest)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fullCalls))
+
+	// the archive strategy skips unavailable archive upstreams
+	rcfg.archive.upstreams[0].state().setStatus(upstreamDisabled)
+
+	req, _ = newRequest([]byte(`{"params": ["0x01", "0x1"], "method": "eth_getBalance", "id": 1, "jsonrpc": "2.0"}`))
+	_, _, err = dispatch(context.Background(), req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, archive2.URL, req.upstream)
+}
+
+func TestArchiveRouterStrategy(t *testing.T) {
+	config := &Config{
+		Strategy:  "NAIVE",
+		Upstreams: []*UpstreamConfig{{Url: "http://test1.com"}},
+		Archive: ArchiveConfig{
+			Upstreams: []*UpstreamConfig{{Url: "http://archive1.com"}, {Url: "ws://archive2.com"}},
+			Strategy:  "RACE",
+		},
+	}
+
+	rcfg, err := BuildRunningConfigFromConfig(context.Background(), config)
+
+	assert.Nil(t, err)
+	assert.IsType(t, &RaceProxy{}, rcfg.archive.strategy)
+	assert.Equal(t, 2, len(rcfg.archive.upstreams))
+
+	config.Archive.Strategy = "QUORUM"
+	_, err = BuildRunningConfigFromConfig(context.Background(), config)
+
+	assert.NotNil(t, err)
+}
+
+func TestOldTrieUrlArchiveUpstream(t *testing.T) {
+	var fullCalls, archiveCalls int32
+	var archiveHeader http.Header
+
+	full := newBodyTestServer(`{"jsonrpc":"2.0","id":1,"result":"0x2"}`, &fullCalls)
+	defer full.Close()
+
+	archive := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&archiveCalls, 1)
+		archiveHeader = r.Header.Clone()
+		_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer archive.Close()
+
+	config := &Config{
+		Strategy:   "NAIVE",
+		Upstreams:  []*UpstreamConfig{{Url: full.URL, Headers: map[string]string{"X-Provider-Key": "secret"}}},
+		OldTrieUrl: archive.URL,
+	}
+
+	rcfg, err := BuildRunningConfigFromConfig(context.Background(), config)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(rcfg.archive.upstreams))
+	assert.Equal(t, 0, len(config.Archive.Upstreams))
+
+	rcfg.Upstreams[0].state().setHead(10000)
+
+	req, _ := newRequest([]byte(`{"params": ["0x01", "0x1"], "method": "eth_getBalance", "id": 1, "jsonrpc": "2.0"}`))
+	_, bts, err := dispatch(context.Background(), req)
+
+	assert.Nil(t, err)
+	assert.Contains(t, string(bts), `"0x1"`)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&archiveCalls))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&fullCalls))
+
+	// the options of the full node are not sent to oldTrieUrl
+	assert.Equal(t, "", archiveHeader.Get("X-Provider-Key"))
+}
@@ -0,0 +1,188 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthConfig sets the Authorization header of the requests to an upstream, only one kind of auth can be set
+type AuthConfig struct {
+	// basic auth credentials
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// sent as "Bearer <token>", for nodes behind reverse proxies
+	BearerToken string `json:"bearerToken,omitempty"`
+	// hex encoded 32 bytes secret shared with the node, as geth's --authrpc.jwtsecret.
+	// HS256 tokens are signed by it and refreshed before the node rejects them.
+	JwtSecretFile string `json:"jwtSecretFile,omitempty"`
+	// id claim of the tokens, optional
+	JwtID string `json:"jwtId,omitempty"`
+}
+
+// nodes reject a token issued more than 60s ago, it's signed again well before that
+const jwtRefreshInterval = 30 * time.Second
+
+const jwtSecretLength = 32
+
+func (c *AuthConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+
+	kinds := 0
+
+	for _, set := range []bool{c.Username != "" || c.Password != "", c.BearerToken != "", c.JwtSecretFile != ""} {
+		if set {
+			kinds++
+		}
+	}
+
+	if kinds > 1 {
+		return fmt.Errorf("only one of basic auth, bearer token and jwt can be set")
+	}
+
+	if c.JwtSecretFile != "" {
+		if _, err := readJwtSecret(c.JwtSecretFile); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readJwtSecret(file string) ([]byte, error) {
+	bts, err := ioutil.ReadFile(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(string(bts)), "0x"))
+
+	if err != nil || len(secret) != jwtSecretLength {
+		return nil, fmt.Errorf("jwt secret file %s should be %d hex encoded bytes", file, jwtSecretLength)
+	}
+
+	return secret, nil
+}
+
+// upstreamAuth makes the Authorization header of an upstream, the jwt is cached until it should be refreshed
+type upstreamAuth struct {
+	lock     sync.Mutex
+	config   *AuthConfig
+	token    string
+	issuedAt time.Time
+}
+
+func newUpstreamAuth(cfg *AuthConfig) *upstreamAuth {
+	if cfg == nil {
+		return nil
+	}
+
+	return &upstreamAuth{config: cfg}
+}
+
+// authorization returns the value of the Authorization header, empty if no auth is set.
+// The secret file is read again on each refresh, so a rotated secret is picked up.
+func (a *upstreamAuth) authorization() (string, error) {
+	if a == nil {
+		return "", nil
+	}
+
+	switch {
+	case a.config.BearerToken != "":
+		return "Bearer " + a.config.BearerToken, nil
+	case a.config.Username != "" || a.config.Password != "":
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(a.config.Username+":"+a.config.Password)), nil
+	case a.config.JwtSecretFile != "":
+		token, err := a.jwt()
+
+		if err != nil {
+			return "", err
+		}
+
+		return "Bearer " + token, nil
+	default:
+		return "", nil
+	}
+}
+
+func (a *upstreamAuth) jwt() (string, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.token != "" && time.Since(a.issuedAt) < jwtRefreshInterval {
+		return a.token, nil
+	}
+
+	secret, err := readJwtSecret(a.config.JwtSecretFile)
+
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	token, err := signJwt(secret, now, a.config.JwtID)
+
+	if err != nil {
+		return "", err
+	}
+
+	a.token, a.issuedAt = token, now
+
+	return token, nil
+}
+
+// signJwt makes an HS256 token with the iat claim, and the id claim if it's not empty
+func signJwt(secret []byte, issuedAt time.Time, id string) (string, error) {
+	claims := map[string]interface{}{"iat": issuedAt.Unix()}
+
+	if id != "" {
+		claims["id"] = id
+	}
+
+	payload, err := json.Marshal(claims)
+
+	if err != nil {
+		return "", err
+	}
+
+	encoding := base64.RawURLEncoding
+	unsigned := encoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + encoding.EncodeToString(payload)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+
+	return unsigned + "." + encoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// header returns the headers sent to the upstream with each http request and websocket handshake,
+// the auth config overrides an Authorization header in the static headers
+func (s *upstreamState) header() (http.Header, error) {
+	header := make(http.Header, len(s.config.Headers)+1)
+
+	for k, v := range s.config.Headers {
+		header.Set(k, v)
+	}
+
+	authorization, err := s.auth.authorization()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if authorization != "" {
+		header.Set("Authorization", authorization)
+	}
+
+	return header, nil
+}
@@ -0,0 +1,228 @@
+package core
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+const testJwtSecret = "0x0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20"
+
+func writeJwtSecret(t *testing.T, secret string) (string, func()) {
+	dir, _ := ioutil.TempDir("", "gateway-jwt")
+	file := filepath.Join(dir, "jwt.hex")
+
+	if err := ioutil.WriteFile(file, []byte(secret+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return file, func() { _ = os.RemoveAll(dir) }
+}
+
+// verifyJwt checks the signature of an HS256 token and returns its claims
+func verifyJwt(t *testing.T, token string, secret []byte) map[string]interface{} {
+	parts := strings.Split(token, ".")
+	assert.Equal(t, 3, len(parts))
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), parts[2])
+
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+
+	var claims map[string]interface{}
+	_ = json.Unmarshal(payload, &claims)
+
+	return claims
+}
+
+func TestAuthConfigValidate(t *testing.T) {
+	file, remove := writeJwtSecret(t, testJwtSecret)
+	defer remove()
+
+	badFile, removeBad := writeJwtSecret(t, "0x0102")
+	defer removeBad()
+
+	var nilConfig *AuthConfig
+	assert.Nil(t, nilConfig.validate())
+	assert.Nil(t, (&AuthConfig{Username: "user", Password: "pass"}).validate())
+	assert.Nil(t, (&AuthConfig{BearerToken: "token"}).validate())
+	assert.Nil(t, (&AuthConfig{JwtSecretFile: file}).validate())
+
+	assert.NotNil(t, (&AuthConfig{Username: "user", BearerToken: "token"}).validate())
+	assert.NotNil(t, (&AuthConfig{JwtSecretFile: filepath.Join(filepath.Dir(file), "none")}).validate())
+	assert.NotNil(t, (&AuthConfig{JwtSecretFile: badFile}).validate())
+}
+
+func TestUpstreamAuthorization(t *testing.T) {
+	authorization, err := newUpstreamAuth(nil).authorization()
+	assert.Nil(t, err)
+	assert.Equal(t, "", authorization)
+
+	authorization, _ = newUpstreamAuth(&AuthConfig{BearerToken: "token"}).authorization()
+	assert.Equal(t, "Bearer token", authorization)
+
+	authorization, _ = newUpstreamAuth(&AuthConfig{Username: "user", Password: "pass"}).authorization()
+	assert.Equal(t, "Basic dXNlcjpwYXNz", authorization)
+}
+
+func TestUpstreamAuthJwt(t *testing.T) {
+	file, remove := writeJwtSecret(t, testJwtSecret)
+	defer remove()
+
+	secret, _ := readJwtSecret(file)
+	auth := newUpstreamAuth(&AuthConfig{JwtSecretFile: file, JwtID: "gateway"})
+
+	authorization, err := auth.authorization()
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(authorization, "Bearer "))
+
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	claims := verifyJwt(t, token, secret)
+	assert.Equal(t, "gateway", claims["id"])
+	assert.InDelta(t, time.Now().Unix(), claims["iat"], 2)
+
+	// cached until it should be refreshed
+	again, _ := auth.authorization()
+	assert.Equal(t, authorization, again)
+
+	// a refreshed token is signed by the rotated secret
+	rotated := "0x" + strings.Repeat("ab", jwtSecretLength)
+	_ = ioutil.WriteFile(file, []byte(rotated), 0600)
+	newSecret, _ := readJwtSecret(file)
+
+	auth.issuedAt = time.Now().Add(-jwtRefreshInterval)
+	authorization, err = auth.authorization()
+	assert.Nil(t, err)
+	verifyJwt(t, strings.TrimPrefix(authorization, "Bearer "), newSecret)
+
+	_ = os.Remove(file)
+	auth.issuedAt = time.Now().Add(-jwtRefreshInterval)
+	_, err = auth.authorization()
+	assert.NotNil(t, err)
+}
+
+func TestHttpUpstreamAuth(t *testing.T) {
+	var header http.Header
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer server.Close()
+
+	buildTestConfig("NAIVE", server.URL)
+
+	u, _ := url.Parse(server.URL)
+	upstream, _ := newHttpUpstream(u, &UpstreamConfig{
+		Headers: map[string]string{"Authorization": "Bearer static", "x-api-key": "key"},
+		Auth:    &AuthConfig{Username: "user", Password: "pass"},
+	})
+
+	req, _ := newRequest([]byte(`{"params": [], "method": "eth_blockNumber", "id": 1, "jsonrpc": "2.0"}`))
+	_, err := upstream.handle(context.Background(), req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "key", header.Get("X-Api-Key"))
+
+	username, password, ok := (&http.Request{Header: header}).BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "user", username)
+	assert.Equal(t, "pass", password)
+}
+
+func TestWsUpstreamAuth(t *testing.T) {
+	file, remove := writeJwtSecret(t, testJwtSecret)
+	defer remove()
+
+	secret, _ := readJwtSecret(file)
+	authorizations := make(chan string, 1)
+	upgrader := websocket.Upgrader{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case authorizations <- r.Header.Get("Authorization"):
+		default:
+		}
+
+		c, err := upgrader.Upgrade(w, r, nil)
+
+		if err != nil {
+			return
+		}
+
+		defer c.Close()
+
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	u, _ := url.Parse(wsTestUrl(server))
+	newWsStream(ctx, u, &UpstreamConfig{Auth: &AuthConfig{JwtSecretFile: file}})
+
+	select {
+	case authorization := <-authorizations:
+		assert.True(t, strings.HasPrefix(authorization, "Bearer "))
+		verifyJwt(t, strings.TrimPrefix(authorization, "Bearer "), secret)
+	case <-time.After(5 * time.Second):
+		t.Fatal("websocket upstream not connected")
+	}
+}
+
+func TestOldTrieUrlAuth(t *testing.T) {
+	var fullAuthorization, archiveAuthorization string
+
+	full := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fullAuthorization = r.Header.Get("Authorization")
+		_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x2"}`))
+	}))
+	defer full.Close()
+
+	archive := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		archiveAuthorization = r.Header.Get("Authorization")
+		_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer archive.Close()
+
+	config := &Config{
+		Strategy:   "NAIVE",
+		Upstreams:  []*UpstreamConfig{{Url: full.URL, Auth: &AuthConfig{BearerToken: "tok"}}},
+		OldTrieUrl: archive.URL,
+	}
+
+	rcfg, err := BuildRunningConfigFromConfig(context.Background(), config)
+	assert.Nil(t, err)
+
+	rcfg.Upstreams[0].state().setHead(10000)
+
+	req, _ := newRequest([]byte(`{"params": ["0x01", "latest"], "method": "eth_getBalance", "id": 1, "jsonrpc": "2.0"}`))
+	_, bts, _ := dispatch(context.Background(), req)
+	assert.Contains(t, string(bts), `"0x2"`)
+	assert.Equal(t, "Bearer tok", fullAuthorization)
+
+	req, _ = newRequest([]byte(`{"params": ["0x01", "0x1"], "method": "eth_getBalance", "id": 1, "jsonrpc": "2.0"}`))
+	_, bts, _ = dispatch(context.Background(), req)
+	assert.Contains(t, string(bts), `"0x1"`)
+	assert.Equal(t, "", archiveAuthorization)
+}
@@ -0,0 +1,275 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// BreakerConfig controls the circuit breaker of each upstream, zero values use the defaults
+type BreakerConfig struct {
+	ConsecutiveFailures int `json:"consecutiveFailures,omitempty"`
+	ErrorRatePercent    int `json:"errorRatePercent,omitempty"`
+	MinRequests         int `json:"minRequests,omitempty"`
+	WindowMs            int `json:"windowMs,omitempty"`
+	OpenMs              int `json:"openMs,omitempty"`
+	MaxOpenMs           int `json:"maxOpenMs,omitempty"`
+	HalfOpenProbes      int `json:"halfOpenProbes,omitempty"`
+}
+
+const (
+	defaultBreakerConsecutiveFailures = 5
+	defaultBreakerErrorRatePercent    = 50
+	defaultBreakerMinRequests         = 20
+	defaultBreakerWindow              = 10 * time.Second
+	defaultBreakerOpen                = 5 * time.Second
+	defaultBreakerMaxOpen             = 60 * time.Second
+	defaultBreakerHalfOpenProbes      = 1
+)
+
+func (c *BreakerConfig) consecutiveFailures() int {
+	return intOrDefault(c.ConsecutiveFailures, defaultBreakerConsecutiveFailures)
+}
+
+func (c *BreakerConfig) errorRatePercent() int {
+	return intOrDefault(c.ErrorRatePercent, defaultBreakerErrorRatePercent)
+}
+
+func (c *BreakerConfig) minRequests() int {
+	return intOrDefault(c.MinRequests, defaultBreakerMinRequests)
+}
+
+func (c *BreakerConfig) window() time.Duration {
+	return durationOrDefault(c.WindowMs, defaultBreakerWindow)
+}
+
+func (c *BreakerConfig) open() time.Duration {
+	return durationOrDefault(c.OpenMs, defaultBreakerOpen)
+}
+
+func (c *BreakerConfig) maxOpen() time.Duration {
+	return durationOrDefault(c.MaxOpenMs, defaultBreakerMaxOpen)
+}
+
+func (c *BreakerConfig) halfOpenProbes() int {
+	return intOrDefault(c.HalfOpenProbes, defaultBreakerHalfOpenProbes)
+}
+
+const (
+	breakerClosed int32 = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func breakerStateText(state int32) string {
+	switch state {
+	case breakerHalfOpen:
+		return "half_open"
+	case breakerOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker stops sending requests to an upstream which keeps failing.
+//
+// It opens after too many consecutive failures, or when the error rate in the
+// current window is too high. After the open duration, a few probe requests are
+// let through (half-open). The breaker closes if all of them succeed, otherwise
+// it opens again for twice as long, up to the max open duration.
+type circuitBreaker struct {
+	lock   sync.Mutex
+	name   string
+	config *BreakerConfig
+	now    func() time.Time
+
+	state               int32
+	consecutiveFailures int
+	windowStart         time.Time
+	requests            int
+	failures            int
+	openUntil           time.Time
+	openDuration        time.Duration
+	probes              int // probes in flight
+	probeSuccesses      int
+}
+
+func newCircuitBreaker(name string, cfg *BreakerConfig) *circuitBreaker {
+	if cfg == nil {
+		cfg = &BreakerConfig{}
+	}
+
+	b := &circuitBreaker{
+		name:   name,
+		config: cfg,
+		now:    time.Now,
+	}
+
+	b.windowStart = b.now()
+	upstreamCircuitState.WithLabelValues(name).Set(float64(breakerClosed))
+
+	return b
+}
+
+// the caller should hold the lock
+func (b *circuitBreaker) setState(state int32) {
+	if b.state == state {
+		return
+	}
+
+	upstreamLog.Infof("upstream %s circuit %s -> %s", b.name, breakerStateText(b.state), breakerStateText(state))
+
+	b.state = state
+	upstreamCircuitState.WithLabelValues(b.name).Set(float64(state))
+	upstreamCircuitTransitionsTotal.WithLabelValues(b.name, breakerStateText(state)).Inc()
+}
+
+// the caller should hold the lock
+func (b *circuitBreaker) trip() {
+	if b.openDuration == 0 {
+		b.openDuration = b.config.open()
+	} else {
+		b.openDuration *= 2
+
+		if b.openDuration > b.config.maxOpen() {
+			b.openDuration = b.config.maxOpen()
+		}
+	}
+
+	b.openUntil = b.now().Add(b.openDuration)
+	b.probes = 0
+	b.probeSuccesses = 0
+	b.setState(breakerOpen)
+}
+
+// the caller should hold the lock
+func (b *circuitBreaker) reset() {
+	b.consecutiveFailures = 0
+	b.windowStart = b.now()
+	b.requests = 0
+	b.failures = 0
+	b.openDuration = 0
+	b.probes = 0
+	b.probeSuccesses = 0
+	b.setState(breakerClosed)
+}
+
+// the caller should hold the lock
+func (b *circuitBreaker) currentState() int32 {
+	if b.state == breakerOpen && !b.now().Before(b.openUntil) {
+		b.setState(breakerHalfOpen)
+	}
+
+	return b.state
+}
+
+func (b *circuitBreaker) stateText() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return breakerStateText(b.currentState())
+}
+
+// ready reports whether a request would be let through now, without taking a probe slot
+func (b *circuitBreaker) ready() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.currentState() {
+	case breakerClosed:
+		return true
+	case breakerHalfOpen:
+		return b.probes < b.config.halfOpenProbes()
+	default:
+		return false
+	}
+}
+
+// acquire is called before every upstream call, a half-open breaker only lets probes through.
+// The result of the call should be recorded with the returned probe flag.
+func (b *circuitBreaker) acquire() (probe bool, ok bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.currentState() {
+	case breakerClosed:
+		return false, true
+	case breakerHalfOpen:
+		if b.probes >= b.config.halfOpenProbes() {
+			return false, false
+		}
+
+		b.probes++
+		return true, true
+	default:
+		return false, false
+	}
+}
+
+// cancelled calls tell nothing about the upstream, and rate limiting has its own backoff,
+// they are not counted
+func isBreakerFailure(err error) bool {
+	return err != nil && !errors.Is(err, context.Canceled) && err != RateLimitedError
+}
+
+func (b *circuitBreaker) record(probe bool, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if probe {
+		if b.state != breakerHalfOpen {
+			return
+		}
+
+		b.probes--
+
+		if err != nil && !isBreakerFailure(err) {
+			// give the slot back to another probe
+			return
+		}
+
+		if err != nil {
+			b.trip()
+			return
+		}
+
+		b.probeSuccesses++
+
+		if b.probeSuccesses >= b.config.halfOpenProbes() {
+			b.reset()
+		}
+
+		return
+	}
+
+	// results of calls started before the breaker opened
+	if b.state != breakerClosed {
+		return
+	}
+
+	if now := b.now(); now.Sub(b.windowStart) >= b.config.window() {
+		b.windowStart = now
+		b.requests = 0
+		b.failures = 0
+	}
+
+	if !isBreakerFailure(err) {
+		if err == nil {
+			b.requests++
+			b.consecutiveFailures = 0
+		}
+
+		return
+	}
+
+	b.requests++
+	b.failures++
+	b.consecutiveFailures++
+
+	if b.consecutiveFailures >= b.config.consecutiveFailures() ||
+		(b.requests >= b.config.minRequests() && b.failures*100 >= b.requests*b.config.errorRatePercent()) {
+		b.trip()
+	}
+}
@@ -0,0 +1,129 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestBreaker(cfg *BreakerConfig) (*circuitBreaker, *time.Time) {
+	now := time.Now()
+	b := newCircuitBreaker("http://breaker.test.com", cfg)
+	b.now = func() time.Time { return now }
+	b.windowStart = now
+	return b, &now
+}
+
+func breakerCall(b *circuitBreaker, err error) bool {
+	probe, ok := b.acquire()
+
+	if ok {
+		b.record(probe, err)
+	}
+
+	return ok
+}
+
+func TestBreakerConsecutiveFailures(t *testing.T) {
+	b, _ := newTestBreaker(&BreakerConfig{ConsecutiveFailures: 3})
+	failure := fmt.Errorf("failure")
+
+	breakerCall(b, failure)
+	breakerCall(b, failure)
+	breakerCall(b, nil)
+	breakerCall(b, failure)
+	breakerCall(b, failure)
+	assert.Equal(t, "closed", b.stateText())
+
+	breakerCall(b, failure)
+	assert.Equal(t, "open", b.stateText())
+	assert.Equal(t, false, b.ready())
+	assert.Equal(t, false, breakerCall(b, nil))
+}
+
+func TestBreakerErrorRate(t *testing.T) {
+	b, now := newTestBreaker(&BreakerConfig{ConsecutiveFailures: 100, MinRequests: 10, ErrorRatePercent: 50, WindowMs: 1000})
+	failure := fmt.Errorf("failure")
+
+	for i := 0; i < 4; i++ {
+		breakerCall(b, failure)
+		breakerCall(b, nil)
+	}
+
+	// the window is over, counters are reset
+	*now = now.Add(time.Second)
+	breakerCall(b, failure)
+	breakerCall(b, nil)
+	assert.Equal(t, "closed", b.stateText())
+
+	for i := 0; i < 4; i++ {
+		breakerCall(b, nil)
+		breakerCall(b, failure)
+	}
+
+	assert.Equal(t, "open", b.stateText())
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	b, now := newTestBreaker(&BreakerConfig{ConsecutiveFailures: 1, OpenMs: 100, MaxOpenMs: 300, HalfOpenProbes: 1})
+	failure := fmt.Errorf("failure")
+
+	breakerCall(b, failure)
+	assert.Equal(t, "open", b.stateText())
+
+	*now = now.Add(100 * time.Millisecond)
+	assert.Equal(t, "half_open", b.stateText())
+	assert.Equal(t, true, b.ready())
+
+	// only one probe is let through
+	probe, ok := b.acquire()
+	assert.Equal(t, true, probe)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, false, b.ready())
+	assert.Equal(t, false, breakerCall(b, nil))
+
+	// failed probe opens the circuit for twice as long
+	b.record(probe, failure)
+	assert.Equal(t, "open", b.stateText())
+	*now = now.Add(100 * time.Millisecond)
+	assert.Equal(t, "open", b.stateText())
+	*now = now.Add(100 * time.Millisecond)
+	assert.Equal(t, "half_open", b.stateText())
+
+	// cancelled probe gives the slot back
+	probe, _ = b.acquire()
+	b.record(probe, context.Canceled)
+	assert.Equal(t, "half_open", b.stateText())
+	assert.Equal(t, true, b.ready())
+
+	assert.Equal(t, true, breakerCall(b, nil))
+	assert.Equal(t, "closed", b.stateText())
+}
+
+func TestBreakerIgnoresCancelledCalls(t *testing.T) {
+	b, _ := newTestBreaker(&BreakerConfig{ConsecutiveFailures: 1})
+
+	breakerCall(b, context.Canceled)
+	assert.Equal(t, "closed", b.stateText())
+
+	breakerCall(b, TimeoutError)
+	assert.Equal(t, "open", b.stateText())
+}
+
+func TestUpstreamOpenCircuit(t *testing.T) {
+	buildTestConfig("FALLBACK", "http://test1.com", "http://test2.com")
+
+	s := currentRunningConfig().Upstreams[0].state()
+	s.breaker.config = &BreakerConfig{ConsecutiveFailures: 1}
+	s.breaker.record(false, TimeoutError)
+
+	assert.Equal(t, false, s.isAvailable())
+	assert.Equal(t, false, s.isHealthy())
+	assert.Equal(t, true, currentRunningConfig().Upstreams[1].state().isAvailable())
+
+	_, _, err := s.begin(context.Background(), getBlockNumberRequest())
+	assert.Equal(t, CircuitOpenError, err)
+}
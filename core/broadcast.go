@@ -0,0 +1,198 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"golang.org/x/crypto/sha3"
+)
+
+// BroadcastConfig sends requests of some methods to all upstreams at once,
+// e.g. eth_sendRawTransaction, so a transaction propagates faster
+type BroadcastConfig struct {
+	Methods []string `json:"methods"`
+	// extra endpoints only receiving broadcast requests, such as private transaction relays
+	SendOnlyUpstreams []*UpstreamConfig `json:"sendOnlyUpstreams"`
+}
+
+// errors of nodes which mean the transaction was already accepted before
+var txKnownErrorMessages = []string{
+	"already known",
+	"known transaction",
+	"already imported",
+	"alreadyknown",
+}
+
+// errors of nodes which mean the transaction may have been accepted by another node
+var txNonceTooLowErrorMessages = []string{
+	"nonce too low",
+	"oldnonce",
+}
+
+type broadcaster struct {
+	methods           map[string]bool
+	sendOnlyUpstreams []Upstream
+}
+
+func newBroadcaster(ctx context.Context, cfg *BroadcastConfig) *broadcaster {
+	b := &broadcaster{
+		methods: make(map[string]bool),
+	}
+
+	for _, method := range cfg.Methods {
+		b.methods[method] = true
+	}
+
+	for _, upstreamConfig := range cfg.SendOnlyUpstreams {
+		b.sendOnlyUpstreams = append(b.sendOnlyUpstreams, newUpstream(ctx, upstreamConfig.Url, upstreamConfig))
+	}
+
+	return b
+}
+
+type broadcastResponse struct {
+	upstream Upstream
+	bts      []byte
+	class    responseClass
+}
+
+func rpcErrorMessageContains(bts []byte, messages []string) bool {
+	var res rpcResponseData
+
+	if json.Unmarshal(bts, &res) != nil || res.Error == nil {
+		return false
+	}
+
+	message := strings.ToLower(res.Error.Message)
+
+	for _, m := range messages {
+		if strings.Contains(message, m) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rawTransactionHash returns the hash of the raw transaction param, empty if it's invalid
+func rawTransactionHash(req *Request) string {
+	if len(req.data.Params) == 0 {
+		return ""
+	}
+
+	raw, _ := req.data.Params[0].(string)
+	bts, err := hexutil.Decode(raw)
+
+	if err != nil {
+		return ""
+	}
+
+	hash := sha3.NewLegacyKeccak256()
+	hash.Write(bts)
+
+	return hexutil.Encode(hash.Sum(nil))
+}
+
+func txHashResponse(req *Request, hash string) []byte {
+	bts, _ := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      req.data.ID,
+		"result":  hash,
+	})
+
+	return bts
+}
+
+// handle sends the request to all available upstreams and send-only upstreams,
+// and returns the first accepted response. The other calls go on after it returns,
+// until the request deadline.
+//
+// For eth_sendRawTransaction, "already known" means accepted. A "nonce too low"
+// is only returned if no upstream accepted the transaction.
+func (b *broadcaster) handle(ctx context.Context, req *Request) ([]byte, error) {
+	upstreams := append(availableUpstreams(), b.sendOnlyUpstreams...)
+
+	if len(upstreams) == 0 {
+		return nil, NoValidUpstreamError
+	}
+
+	// the broadcast is not stopped by the client going away
+	deadline, ok := ctx.Deadline()
+
+	if !ok {
+		deadline = time.Now().Add(currentRunningConfig().requestTimeout)
+	}
+
+	broadcastCtx, cancel := context.WithDeadline(context.WithoutCancel(ctx), deadline)
+
+	responses := make(chan *broadcastResponse, len(upstreams))
+	received := 0
+
+	for _, upstream := range upstreams {
+		go func(upstream Upstream) {
+			bts, err := upstream.handle(broadcastCtx, req)
+			req.logger.Debugf("broadcast %s to %s, err: %v, body: %s", req.data.Method, upstream.state().name, err, strings.TrimSpace(string(bts)))
+			responses <- &broadcastResponse{upstream, bts, classifyResponse(bts, err)}
+		}(upstream)
+	}
+
+	// cancel the context once all calls are done
+	defer func() {
+		go func(received int) {
+			for ; received < len(upstreams); received++ {
+				<-responses
+			}
+
+			cancel()
+		}(received)
+	}()
+
+	isSendTx := req.data.Method == "eth_sendRawTransaction"
+
+	var rejected, retryable *broadcastResponse
+
+	for received < len(upstreams) {
+		var res *broadcastResponse
+
+		select {
+		case <-ctx.Done():
+			return nil, contextError(ctx)
+		case res = <-responses:
+			received++
+		}
+
+		if res.class == responseSuccess {
+			req.setUpstream(res.upstream)
+			return res.bts, nil
+		}
+
+		if isSendTx && res.class == responseDeterministicError && rpcErrorMessageContains(res.bts, txKnownErrorMessages) {
+			if hash := rawTransactionHash(req); hash != "" {
+				req.setUpstream(res.upstream)
+				return txHashResponse(req, hash), nil
+			}
+		}
+
+		switch res.class {
+		case responseDeterministicError:
+			// prefer errors other than nonce too low, which may be caused by another upstream accepting the transaction
+			if rejected == nil || (isSendTx && rpcErrorMessageContains(rejected.bts, txNonceTooLowErrorMessages)) {
+				rejected = res
+			}
+		case responseRetryableError:
+			retryable = res
+		}
+	}
+
+	for _, res := range []*broadcastResponse{rejected, retryable} {
+		if res != nil {
+			req.setUpstream(res.upstream)
+			return res.bts, nil
+		}
+	}
+
+	return nil, AllUpstreamsFailedError
+}
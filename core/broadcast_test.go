@@ -0,0 +1,87 @@
+package core
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	nonceTooLowBody  = `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"nonce too low"}}`
+	alreadyKnownBody = `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"already known"}}`
+	noFundsBody      = `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"insufficient funds for gas * price + value"}}`
+)
+
+func sendRawTransactionRequest() *Request {
+	req, _ := newRequest([]byte(`{"params": ["0x"], "method": "eth_sendRawTransaction", "id": 1, "jsonrpc": "2.0"}`))
+	return req
+}
+
+func TestRawTransactionHash(t *testing.T) {
+	buildTestConfig("NAIVE", "http://test1.com")
+
+	assert.Equal(t, "0xc5d2460186f7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a470", rawTransactionHash(sendRawTransactionRequest()))
+
+	req, _ := newRequest([]byte(`{"params": ["not hex"], "method": "eth_sendRawTransaction", "id": 1, "jsonrpc": "2.0"}`))
+	assert.Equal(t, "", rawTransactionHash(req))
+}
+
+func TestBroadcast(t *testing.T) {
+	var calls, relayCalls int32
+
+	nonceTooLow := newBodyTestServer(nonceTooLowBody, &calls)
+	defer nonceTooLow.Close()
+
+	alreadyKnown := newBodyTestServer(alreadyKnownBody, &calls)
+	defer alreadyKnown.Close()
+
+	noFunds := newBodyTestServer(noFundsBody, &calls)
+	defer noFunds.Close()
+
+	accepted := newDelayedTestServer("0xabcd", 20*time.Millisecond, &calls)
+	defer accepted.Close()
+
+	relay := newDelayedTestServer("0xabcd", 0, &relayCalls)
+	defer relay.Close()
+
+	cases := []struct {
+		upstreams []string
+		contains  string
+	}{
+		// wait for the accepting upstream
+		{[]string{nonceTooLow.URL, accepted.URL}, "0xabcd"},
+		// already known means accepted, the hash is computed by the gateway
+		{[]string{nonceTooLow.URL, alreadyKnown.URL}, "0xc5d2460186f7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a470"},
+		// other errors are preferred to nonce too low
+		{[]string{nonceTooLow.URL, noFunds.URL}, "insufficient funds"},
+		{[]string{noFunds.URL, nonceTooLow.URL}, "insufficient funds"},
+	}
+
+	for _, c := range cases {
+		buildTestConfig("FALLBACK", c.upstreams...)
+		b := newBroadcaster(context.Background(), &BroadcastConfig{Methods: []string{"eth_sendRawTransaction"}})
+
+		bts, err := b.handle(context.Background(), sendRawTransactionRequest())
+
+		assert.Nil(t, err)
+		assert.Contains(t, string(bts), c.contains)
+	}
+
+	// send-only upstreams receive broadcast requests
+	rcfg := buildTestConfig("FALLBACK", nonceTooLow.URL, noFunds.URL)
+	rcfg.broadcaster = newBroadcaster(context.Background(), &BroadcastConfig{
+		Methods:           []string{"eth_sendRawTransaction"},
+		SendOnlyUpstreams: []*UpstreamConfig{{Url: relay.URL}},
+	})
+
+	req := sendRawTransactionRequest()
+	_, bts, err := dispatch(context.Background(), req)
+
+	assert.Nil(t, err)
+	assert.Contains(t, string(bts), "0xabcd")
+	assert.Equal(t, relay.URL, req.upstream)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&relayCalls))
+}
@@ -0,0 +1,131 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+type responseClass int
+
+// classes are ordered from the best to the worst
+const (
+	// a result, it can be returned to the client
+	responseSuccess responseClass = iota
+	// an error every node would return, e.g. execution reverted, it can be returned to the client as-is
+	responseDeterministicError
+	// an error of the node which served the request, another node may succeed
+	responseRetryableError
+	// no valid json-rpc response from the upstream
+	responseTransportError
+)
+
+func (c responseClass) String() string {
+	switch c {
+	case responseSuccess:
+		return "success"
+	case responseDeterministicError:
+		return "deterministic_error"
+	case responseRetryableError:
+		return "retryable_error"
+	default:
+		return "transport_error"
+	}
+}
+
+// the answer is final, no need to ask another upstream
+func (c responseClass) isFinal() bool {
+	return c == responseSuccess || c == responseDeterministicError
+}
+
+// error codes of providers meaning the request can be sent to another node
+var retryableErrorCodes = map[int]bool{
+	-32005: true, // limit exceeded
+	429:    true, // too many requests
+}
+
+// error messages of nodes which are lagging, pruned or overloaded
+var retryableErrorMessages = []string{
+	"missing trie node",
+	"header not found",
+	"unknown block",
+	"block not found",
+	"rate limit",
+	"too many requests",
+	"limit exceeded",
+	"capacity exceeded",
+	"timeout",
+	"timed out",
+	"service unavailable",
+	"internal error",
+}
+
+type rpcResponseData struct {
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// classifyResponse tells whether the result of an upstream call can be returned to the client
+func classifyResponse(bts []byte, err error) responseClass {
+	if err != nil {
+		return responseTransportError
+	}
+
+	if trimmed := bytes.TrimLeft(bts, " \t\r\n"); len(trimmed) > 0 && trimmed[0] == '[' {
+		return classifyBatchResponse(trimmed)
+	}
+
+	return classifySingleResponse(bts)
+}
+
+// a batch response is classified as its worst response, an empty batch is not a valid response
+func classifyBatchResponse(bts []byte) responseClass {
+	var responses []json.RawMessage
+
+	if json.Unmarshal(bts, &responses) != nil || len(responses) == 0 {
+		return responseTransportError
+	}
+
+	class := responseSuccess
+
+	for _, res := range responses {
+		if c := classifySingleResponse(res); c > class {
+			class = c
+		}
+	}
+
+	return class
+}
+
+func classifySingleResponse(bts []byte) responseClass {
+	var res rpcResponseData
+
+	if json.Unmarshal(bts, &res) != nil {
+		return responseTransportError
+	}
+
+	if res.Error == nil {
+		if res.Result == nil {
+			return responseTransportError
+		}
+
+		return responseSuccess
+	}
+
+	if retryableErrorCodes[res.Error.Code] {
+		return responseRetryableError
+	}
+
+	message := strings.ToLower(res.Error.Message)
+
+	for _, m := range retryableErrorMessages {
+		if strings.Contains(message, m) {
+			return responseRetryableError
+		}
+	}
+
+	return responseDeterministicError
+}
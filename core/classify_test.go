@@ -0,0 +1,41 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyResponse(t *testing.T) {
+	cases := []struct {
+		bts   string
+		err   error
+		class responseClass
+	}{
+		{`{"jsonrpc":"2.0","id":1,"result":"0x1"}`, nil, responseSuccess},
+		{`{"jsonrpc":"2.0","id":1,"result":null}`, nil, responseSuccess},
+		{`{"jsonrpc":"2.0","id":1,"error":{"code":3,"message":"execution reverted"}}`, nil, responseDeterministicError},
+		{`{"jsonrpc":"2.0","id":1,"error":{"code":-32601,"message":"the method eth_foo does not exist"}}`, nil, responseDeterministicError},
+		{`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"missing trie node 0x1234 (path )"}}`, nil, responseRetryableError},
+		{`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"header not found"}}`, nil, responseRetryableError},
+		{`{"jsonrpc":"2.0","id":1,"error":{"code":-32005,"message":"daily request count exceeded"}}`, nil, responseRetryableError},
+		{`<html><body>502 Bad Gateway</body></html>`, nil, responseTransportError},
+		{`{"jsonrpc":"2.0","id":1}`, nil, responseTransportError},
+		{``, fmt.Errorf("connection refused"), responseTransportError},
+		{`[{"jsonrpc":"2.0","id":1,"result":"0x1"},{"jsonrpc":"2.0","id":2,"result":"0x2"}]`, nil, responseSuccess},
+		{` [{"jsonrpc":"2.0","id":1,"result":"0x1"},{"jsonrpc":"2.0","id":2,"error":{"code":3,"message":"execution reverted"}}]`, nil, responseDeterministicError},
+		{`[{"jsonrpc":"2.0","id":1,"result":"0x1"},{"jsonrpc":"2.0","id":2,"error":{"code":-32000,"message":"header not found"}}]`, nil, responseRetryableError},
+		{`[{"jsonrpc":"2.0","id":1,"result":"0x1"},"oops"]`, nil, responseTransportError},
+		{`[]`, nil, responseTransportError},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.class, classifyResponse([]byte(c.bts), c.err), c.bts)
+	}
+
+	assert.True(t, responseSuccess.isFinal())
+	assert.True(t, responseDeterministicError.isFinal())
+	assert.False(t, responseRetryableError.isFinal())
+	assert.False(t, responseTransportError.isFinal())
+}
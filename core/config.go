@@ -5,33 +5,197 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/sirupsen/logrus"
 )
 
 type Config struct {
-	Upstreams               []string `json:"upstreams"`
-	OldTrieUrl              string   `json:"oldTrieUrl"`
-	Strategy                string   `json:"strategy"`
-	MethodLimitationEnabled bool     `json:"methodLimitationEnabled"`
-	AllowedMethods          []string `json:"allowedMethods"`
-	ContractWhitelist       []string `json:"contractWhitelist"`
+	Upstreams               []*UpstreamConfig    `json:"upstreams"`
+	OldTrieUrl              string               `json:"oldTrieUrl"`
+	Archive                 ArchiveConfig        `json:"archive"`
+	HeadTracker             HeadTrackerConfig    `json:"headTracker"`
+	Strategy                string               `json:"strategy"`
+	RequestTimeoutMs        int                  `json:"requestTimeoutMs"`
+	MethodLimitationEnabled bool                 `json:"methodLimitationEnabled"`
+	AllowedMethods          []string             `json:"allowedMethods"`
+	ContractWhitelist       []string             `json:"contractWhitelist"`
+	CircuitBreaker          BreakerConfig        `json:"circuitBreaker"`
+	Hedge                   HedgeConfig          `json:"hedge"`
+	Fastest                 FastestConfig        `json:"fastest"`
+	Quorum                  QuorumConfig         `json:"quorum"`
+	StickySession           StickySessionConfig  `json:"stickySession"`
+	ReadYourWrites          ReadYourWritesConfig `json:"readYourWrites"`
+	Broadcast               BroadcastConfig      `json:"broadcast"`
+	TxTracker               TxTrackerConfig      `json:"txTracker"`
+	Websocket               WebsocketConfig      `json:"websocket"`
+	AdminToken              string               `json:"adminToken,omitempty"`
+	Log                     LogConfig            `json:"log"`
+}
+
+// UpstreamConfig can be written as a bare url string, or an object with the url and options
+type UpstreamConfig struct {
+	Url               string `json:"url"`
+	ConnectTimeoutMs  int    `json:"connectTimeoutMs,omitempty"`
+	RequestTimeoutMs  int    `json:"requestTimeoutMs,omitempty"`
+	Retries           int    `json:"retries,omitempty"`
+	RetryBackoffMs    int    `json:"retryBackoffMs,omitempty"`
+	MaxRetryBackoffMs int    `json:"maxRetryBackoffMs,omitempty"`
+	ReconnectDelayMs  int    `json:"reconnectDelayMs,omitempty"`
+
+	// the reconnect delay of websocket upstreams doubles on each failure up to this
+	MaxReconnectDelayMs int `json:"maxReconnectDelayMs,omitempty"`
+	// websocket connections are pinged in this interval, and closed if nothing is received in two intervals
+	PingIntervalMs int `json:"pingIntervalMs,omitempty"`
+
+	// websocket connections to the upstream, each one is reconnected on its own
+	Connections int `json:"connections,omitempty"`
+	// requests waiting for a response on a websocket connection, 0 is unlimited
+	MaxInFlightPerConnection int `json:"maxInFlightPerConnection,omitempty"`
+
+	// overrides the circuit breaker config of the gateway
+	CircuitBreaker *BreakerConfig `json:"circuitBreaker,omitempty"`
+
+	// connection options of the upstream
+	Transport *TransportConfig `json:"transport,omitempty"`
+	// sent with each http request and websocket handshake, such as auth tokens of the provider
+	Headers map[string]string `json:"headers,omitempty"`
+	// basic auth, bearer token or jwt of the upstream
+	Auth *AuthConfig `json:"auth,omitempty"`
+}
+
+const (
+	defaultRequestTimeout  = 30 * time.Second
+	defaultConnectTimeout  = 5 * time.Second
+	defaultUpstreamTimeout = 10 * time.Second
+	defaultRetryBackoff    = 100 * time.Millisecond
+	defaultMaxRetryBackoff = 2 * time.Second
+	defaultReconnectDelay  = 5 * time.Second
+	defaultMaxReconnect    = time.Minute
+	defaultPingInterval    = 30 * time.Second
+)
+
+func (c *UpstreamConfig) UnmarshalJSON(data []byte) error {
+	var url string
+
+	if err := json.Unmarshal(data, &url); err == nil {
+		*c = UpstreamConfig{Url: url}
+		return nil
+	}
+
+	type plainUpstreamConfig UpstreamConfig
+	return json.Unmarshal(data, (*plainUpstreamConfig)(c))
+}
+
+// allUpstreams returns the configs of the upstreams, archive upstreams and send-only upstreams
+func (c *Config) allUpstreams() []*UpstreamConfig {
+	var upstreams []*UpstreamConfig
+
+	upstreams = append(upstreams, c.Upstreams...)
+	upstreams = append(upstreams, c.archiveUpstreams()...)
+	upstreams = append(upstreams, c.Broadcast.SendOnlyUpstreams...)
+
+	return upstreams
+}
+
+// archiveUpstreams returns the archive upstreams, oldTrieUrl is an archive upstream without options
+// when none is set, so the options of the full nodes, such as headers and auth, are never sent to it
+func (c *Config) archiveUpstreams() []*UpstreamConfig {
+	if len(c.Archive.Upstreams) == 0 && c.OldTrieUrl != "" {
+		return []*UpstreamConfig{{Url: c.OldTrieUrl}}
+	}
+
+	return c.Archive.Upstreams
+}
+
+func durationOrDefault(ms int, defaultValue time.Duration) time.Duration {
+	if ms <= 0 {
+		return defaultValue
+	}
+
+	return time.Duration(ms) * time.Millisecond
+}
+
+func intOrDefault(v int, defaultValue int) int {
+	if v <= 0 {
+		return defaultValue
+	}
+
+	return v
+}
+
+func floatOrDefault(v float64, defaultValue float64) float64 {
+	if v <= 0 {
+		return defaultValue
+	}
+
+	return v
+}
+
+func (c *UpstreamConfig) connectTimeout() time.Duration {
+	return durationOrDefault(c.ConnectTimeoutMs, defaultConnectTimeout)
+}
+
+func (c *UpstreamConfig) requestTimeout() time.Duration {
+	return durationOrDefault(c.RequestTimeoutMs, defaultUpstreamTimeout)
+}
+
+func (c *UpstreamConfig) retryBackoff() time.Duration {
+	return durationOrDefault(c.RetryBackoffMs, defaultRetryBackoff)
+}
+
+func (c *UpstreamConfig) maxRetryBackoff() time.Duration {
+	return durationOrDefault(c.MaxRetryBackoffMs, defaultMaxRetryBackoff)
+}
+
+func (c *UpstreamConfig) reconnectDelay() time.Duration {
+	return durationOrDefault(c.ReconnectDelayMs, defaultReconnectDelay)
+}
+
+func (c *UpstreamConfig) maxReconnectDelay() time.Duration {
+	return durationOrDefault(c.MaxReconnectDelayMs, defaultMaxReconnect)
+}
+
+func (c *UpstreamConfig) pingInterval() time.Duration {
+	return durationOrDefault(c.PingIntervalMs, defaultPingInterval)
+}
+
+func (c *UpstreamConfig) connections() int {
+	return intOrDefault(c.Connections, 1)
 }
 
 type RunningConfig struct {
 	ctx                     context.Context
 	stop                    context.CancelFunc
+	config                  *Config
 	Upstreams               []Upstream
-	Strategy                IStrategy
+	strategyLock            sync.RWMutex
+	strategyName            string
+	strategy                IStrategy
+	requestTimeout          time.Duration
+	archiveBlockThreshold   int
+	heads                   *headTracker
+	archive                 *archiveRouter  // nil if there are no archive upstreams
+	sessions                *stickySessions // nil if sticky sessions are disabled
+	txRoutes                *txRoutes       // nil if read-your-writes is disabled
+	broadcaster             *broadcaster
+	txTracker               *txTracker // nil if the transaction tracker is disabled
 	MethodLimitationEnabled bool
 	allowedMethods          map[string]bool
 	allowedCallContracts    map[string]bool
 }
 
 var currentConfigString string = ""
-var currentRunningConfig *RunningConfig
+
+// runningConfig is only replaced by a config which is fully built
+var runningConfig atomic.Pointer[RunningConfig]
+
+// currentRunningConfig returns the running config, a request should read it once and keep using it
+func currentRunningConfig() *RunningConfig {
+	return runningConfig.Load()
+}
 
 func LoadConfig(ctx context.Context, quit chan bool) {
 
@@ -42,14 +206,14 @@ func LoadConfig(ctx context.Context, quit chan bool) {
 			case <-ticker.C:
 				config := &Config{}
 
-				logrus.Debugf("load config from file")
+				configLog.Debugf("load config from file")
 				bts, err := ioutil.ReadFile("./config.json")
 
 				if err != nil {
 					if currentConfigString == "" {
-						logrus.Fatal(err)
+						configLog.Fatal(err)
 					} else {
-						logrus.Warn("hot read config err, use old config")
+						configLog.Warn("hot read config err, use old config")
 						continue
 					}
 				}
@@ -57,21 +221,23 @@ func LoadConfig(ctx context.Context, quit chan bool) {
 				if string(bts) != currentConfigString {
 					_ = json.Unmarshal(bts, config)
 
-					currentRunningConfig, err = BuildRunningConfigFromConfig(ctx, config)
-
-					if err != nil {
+					if err := reloadRunningConfig(ctx, config); err != nil {
 						if currentConfigString == "" {
-							logrus.Fatal(err)
+							configLog.Fatal(err)
 						} else {
-							logrus.Warn("hot build config err, use old config")
+							configLog.Warnf("hot build config err, use old config, %v", err)
 							continue
 						}
 					}
 
+					if err := ApplyLogConfig(config.Log); err != nil {
+						configLog.Warnf("invalid log config, %v", err)
+					}
+
 					currentConfigString = string(bts)
 				}
 			case <-quit:
-				logrus.Info("quit loop config")
+				configLog.Info("quit loop config")
 				ticker.Stop()
 				return
 			}
@@ -79,54 +245,121 @@ func LoadConfig(ctx context.Context, quit chan bool) {
 	}()
 }
 
+// reloadRunningConfig replaces the running config, the previous one keeps running if the config is invalid.
+// Otherwise it's stopped once the requests it's serving have timed out.
+func reloadRunningConfig(ctx context.Context, cfg *Config) error {
+	previous := currentRunningConfig()
+
+	rcfg, err := BuildRunningConfigFromConfig(ctx, cfg)
+
+	if err != nil {
+		return err
+	}
+
+	if previous == nil {
+		return nil
+	}
+
+	// the tracked transactions are checked by the new config at once
+	if previous.txTracker != nil {
+		if rcfg.txTracker != nil {
+			rcfg.txTracker.takeOver(previous.txTracker)
+		} else {
+			previous.txTracker.stop()
+		}
+	}
+
+	time.AfterFunc(previous.requestTimeout, previous.stop)
+
+	return nil
+}
+
+// BuildRunningConfigFromConfig builds the running config and makes it the current one once it's built,
+// the current one is kept if it fails
 func BuildRunningConfigFromConfig(parentContext context.Context, cfg *Config) (*RunningConfig, error) {
+	// a bad url, tls file, proxy url or auth fails the config instead of the upstream
+	for _, upstreamConfig := range cfg.allUpstreams() {
+		if u, err := url.Parse(upstreamConfig.Url); err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "ws" && u.Scheme != "wss") {
+			return nil, fmt.Errorf("upstream %s: unsupported url", upstreamConfig.Url)
+		}
+
+		if _, err := newHttpTransport(upstreamConfig); err != nil {
+			return nil, fmt.Errorf("upstream %s: %v", upstreamConfig.Url, err)
+		}
+
+		if err := upstreamConfig.Auth.validate(); err != nil {
+			return nil, fmt.Errorf("upstream %s: %v", upstreamConfig.Url, err)
+		}
+	}
+
 	ctx, stop := context.WithCancel(parentContext)
 
 	rcfg := &RunningConfig{
-		ctx:  ctx,
-		stop: stop,
+		ctx:    ctx,
+		stop:   stop,
+		config: cfg,
 	}
 
-	currentRunningConfig = rcfg
-
-	for _, url := range cfg.Upstreams {
+	built := false
 
-		var primaryUrl string
-		var oldTrieUrl string
+	defer func() {
+		if !built {
+			stop()
+		}
+	}()
 
-		if cfg.OldTrieUrl != "" {
-			primaryUrl = url
-			oldTrieUrl = cfg.OldTrieUrl
-		} else {
-			primaryUrl = url
-			oldTrieUrl = url
+	for _, upstreamConfig := range cfg.Upstreams {
+		if upstreamConfig.CircuitBreaker == nil {
+			upstreamConfig.CircuitBreaker = &cfg.CircuitBreaker
 		}
 
-		rcfg.Upstreams = append(rcfg.Upstreams, newUpstream(ctx, primaryUrl, oldTrieUrl))
+		rcfg.Upstreams = append(rcfg.Upstreams, newUpstream(ctx, upstreamConfig.Url, upstreamConfig))
 	}
 
 	if len(rcfg.Upstreams) == 0 {
 		return nil, fmt.Errorf("need upstreams")
 	}
 
-	switch cfg.Strategy {
-	case "NAIVE":
-		if len(rcfg.Upstreams) > 1 {
-			panic(fmt.Errorf("naive proxy strategy require exact 1 upstream"))
-		}
-		rcfg.Strategy = newNaiveProxy()
-	case "RACE":
-		if len(rcfg.Upstreams) < 2 {
-			panic(fmt.Errorf("race proxy strategy require more than 1 upstream"))
-		}
-		rcfg.Strategy = newRaceProxy()
-	case "FALLBACK":
-		if len(rcfg.Upstreams) < 2 {
-			panic(fmt.Errorf("fallback proxy strategy require more than 1 upstream"))
+	strategy, err := newStrategy(rcfg, cfg.Strategy)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rcfg.strategyName = cfg.Strategy
+	rcfg.strategy = strategy
+	rcfg.requestTimeout = durationOrDefault(cfg.RequestTimeoutMs, defaultRequestTimeout)
+	rcfg.archiveBlockThreshold = intOrDefault(cfg.Archive.BlockThreshold, defaultArchiveBlockThreshold)
+
+	rcfg.heads = newHeadTracker(ctx, &cfg.HeadTracker, rcfg.Upstreams)
+
+	if archiveUpstreams := cfg.archiveUpstreams(); len(archiveUpstreams) > 0 {
+		archive, err := newArchiveRouter(ctx, cfg, archiveUpstreams)
+
+		if err != nil {
+			return nil, err
 		}
-		rcfg.Strategy = newFallbackProxy()
-	default:
-		return nil, fmt.Errorf("blank of unsupported strategy: %s", cfg.Strategy)
+
+		rcfg.archive = archive
+	}
+
+	if err := cfg.StickySession.validate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.StickySession.By != "" {
+		rcfg.sessions = newStickySessions(ctx, durationOrDefault(cfg.StickySession.WindowMs, defaultStickySessionWindow))
+	}
+
+	if cfg.ReadYourWrites.Enabled {
+		rcfg.txRoutes = newTxRoutes(ctx, &cfg.ReadYourWrites)
+	}
+
+	rcfg.broadcaster = newBroadcaster(ctx, &cfg.Broadcast)
+
+	if cfg.TxTracker.Enabled {
+		rcfg.txTracker = newTxTracker(&cfg.TxTracker)
+		go rcfg.txTracker.run(ctx)
 	}
 
 	rcfg.MethodLimitationEnabled = cfg.MethodLimitationEnabled
@@ -141,5 +374,79 @@ func BuildRunningConfigFromConfig(parentContext context.Context, cfg *Config) (*
 		rcfg.allowedCallContracts[strings.ToLower(cfg.ContractWhitelist[i])] = true
 	}
 
+	built = true
+	runningConfig.Store(rcfg)
+
 	return rcfg, nil
 }
+
+// newStrategy fails if the upstreams count of the running config doesn't match the strategy requirement
+func newStrategy(rcfg *RunningConfig, name string) (IStrategy, error) {
+	upstreamsCount := len(rcfg.Upstreams)
+
+	switch name {
+	case "NAIVE":
+		if upstreamsCount > 1 {
+			return nil, fmt.Errorf("naive proxy strategy require exact 1 upstream")
+		}
+		return newNaiveProxy(), nil
+	case "RACE":
+		if upstreamsCount < 2 {
+			return nil, fmt.Errorf("race proxy strategy require more than 1 upstream")
+		}
+		return newRaceProxy(), nil
+	case "FALLBACK":
+		if upstreamsCount < 2 {
+			return nil, fmt.Errorf("fallback proxy strategy require more than 1 upstream")
+		}
+		return newFallbackProxy(), nil
+	case "HEDGE":
+		if upstreamsCount < 2 {
+			return nil, fmt.Errorf("hedge proxy strategy require more than 1 upstream")
+		}
+		return newHedgeProxy(rcfg), nil
+	case "FASTEST":
+		if upstreamsCount < 2 {
+			return nil, fmt.Errorf("fastest proxy strategy require more than 1 upstream")
+		}
+		return newFastestProxy(rcfg), nil
+	case "QUORUM":
+		if upstreamsCount < 2 {
+			return nil, fmt.Errorf("quorum proxy strategy require more than 1 upstream")
+		}
+
+		p, err := newQuorumProxy(rcfg)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return p, nil
+	default:
+		return nil, fmt.Errorf("blank of unsupported strategy: %s", name)
+	}
+}
+
+func (rcfg *RunningConfig) getStrategy() (string, IStrategy) {
+	rcfg.strategyLock.RLock()
+	defer rcfg.strategyLock.RUnlock()
+
+	return rcfg.strategyName, rcfg.strategy
+}
+
+// switchStrategy replaces the running strategy without touching the config file
+func (rcfg *RunningConfig) switchStrategy(name string) error {
+	strategy, err := newStrategy(rcfg, name)
+
+	if err != nil {
+		return err
+	}
+
+	rcfg.strategyLock.Lock()
+	defer rcfg.strategyLock.Unlock()
+
+	rcfg.strategyName = name
+	rcfg.strategy = strategy
+
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -33,13 +34,13 @@ func TestBuildRunningConfigFromConfigNAIVE(t *testing.T) {
 
 	err := json.Unmarshal([]byte(testConfigStr1), config)
 
-	currentRunningConfig, err := BuildRunningConfigFromConfig(context.Background(), config)
+	rcfg, err := BuildRunningConfigFromConfig(context.Background(), config)
 
 	if err != nil {
 		logrus.Fatal(err)
 	}
 
-	assert.Equal(t, true, currentRunningConfig.MethodLimitationEnabled)
+	assert.Equal(t, true, rcfg.MethodLimitationEnabled)
 
 	var testConfigStr2 = `{
 		"_upstreams": "support http, https, ws, wss",
@@ -63,7 +64,8 @@ func TestBuildRunningConfigFromConfigNAIVE(t *testing.T) {
 
 	err = json.Unmarshal([]byte(testConfigStr2), config)
 
-	assert.Panics(t, func() { BuildRunningConfigFromConfig(context.Background(), config) })
+	_, err = BuildRunningConfigFromConfig(context.Background(), config)
+	assert.NotNil(t, err)
 }
 
 func TestBuildRunningConfigFromConfigRACE(t *testing.T) {
@@ -91,13 +93,13 @@ func TestBuildRunningConfigFromConfigRACE(t *testing.T) {
 
 	err := json.Unmarshal([]byte(testConfigStr1), config)
 
-	currentRunningConfig, err := BuildRunningConfigFromConfig(context.Background(), config)
+	rcfg, err := BuildRunningConfigFromConfig(context.Background(), config)
 
 	if err != nil {
 		logrus.Fatal(err)
 	}
 
-	assert.Equal(t, true, currentRunningConfig.MethodLimitationEnabled)
+	assert.Equal(t, true, rcfg.MethodLimitationEnabled)
 
 	var testConfigStr2 = `{
 		"_upstreams": "support http, https, ws, wss",
@@ -120,7 +122,8 @@ func TestBuildRunningConfigFromConfigRACE(t *testing.T) {
 
 	err = json.Unmarshal([]byte(testConfigStr2), config)
 
-	assert.Panics(t, func() { BuildRunningConfigFromConfig(context.Background(), config) })
+	_, err = BuildRunningConfigFromConfig(context.Background(), config)
+	assert.NotNil(t, err)
 }
 
 func TestBuildRunningConfigFromConfigFALLBACK(t *testing.T) {
@@ -148,13 +151,13 @@ func TestBuildRunningConfigFromConfigFALLBACK(t *testing.T) {
 
 	err := json.Unmarshal([]byte(testConfigStr1), config)
 
-	currentRunningConfig, err := BuildRunningConfigFromConfig(context.Background(), config)
+	rcfg, err := BuildRunningConfigFromConfig(context.Background(), config)
 
 	if err != nil {
 		logrus.Fatal(err)
 	}
 
-	assert.Equal(t, true, currentRunningConfig.MethodLimitationEnabled)
+	assert.Equal(t, true, rcfg.MethodLimitationEnabled)
 
 	var testConfigStr2 = `{
 		"_upstreams": "support http, https, ws, wss",
@@ -177,7 +180,8 @@ func TestBuildRunningConfigFromConfigFALLBACK(t *testing.T) {
 
 	err = json.Unmarshal([]byte(testConfigStr2), config)
 
-	assert.Panics(t, func() { BuildRunningConfigFromConfig(context.Background(), config) })
+	_, err = BuildRunningConfigFromConfig(context.Background(), config)
+	assert.NotNil(t, err)
 }
 
 func TestBuildRunningConfigFromConfigOldTreeUrl(t *testing.T) {
@@ -207,13 +211,13 @@ func TestBuildRunningConfigFromConfigOldTreeUrl(t *testing.T) {
 
 	err := json.Unmarshal([]byte(testConfigStr1), config)
 
-	currentRunningConfig, err := BuildRunningConfigFromConfig(context.Background(), config)
+	rcfg, err := BuildRunningConfigFromConfig(context.Background(), config)
 
 	if err != nil {
 		logrus.Fatal(err)
 	}
 
-	assert.Equal(t, true, currentRunningConfig.MethodLimitationEnabled)
+	assert.Equal(t, true, rcfg.MethodLimitationEnabled)
 
 	var testConfigStr2 = `{
 		"_upstreams": "support http, https, ws, wss",
@@ -239,7 +243,85 @@ func TestBuildRunningConfigFromConfigOldTreeUrl(t *testing.T) {
 
 	err = json.Unmarshal([]byte(testConfigStr2), config)
 
-	currentRunningConfig, err = BuildRunningConfigFromConfig(context.Background(), config)
+	_, err = BuildRunningConfigFromConfig(context.Background(), config)
 
 	assert.Equal(t, "https://ropsten.infura.io/v3/83438c4dcf834ceb8944162688749707x", config.OldTrieUrl)
 }
+
+func buildTestConfig(strategy string, upstreams ...string) *RunningConfig {
+	config := &Config{Strategy: strategy}
+
+	for _, url := range upstreams {
+		config.Upstreams = append(config.Upstreams, &UpstreamConfig{Url: url})
+	}
+
+	rcfg, err := BuildRunningConfigFromConfig(context.Background(), config)
+
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	return rcfg
+}
+
+func TestUpstreamConfigUnmarshal(t *testing.T) {
+	config := &Config{}
+
+	err := json.Unmarshal([]byte(`{
+		"upstreams": [
+		  "http://test1.com",
+		  {"url": "ws://test2.com", "requestTimeoutMs": 3000, "retries": 2}
+		]
+	}`), config)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "http://test1.com", config.Upstreams[0].Url)
+	assert.Equal(t, defaultUpstreamTimeout, config.Upstreams[0].requestTimeout())
+	assert.Equal(t, "ws://test2.com", config.Upstreams[1].Url)
+	assert.Equal(t, 3*time.Second, config.Upstreams[1].requestTimeout())
+	assert.Equal(t, 2, config.Upstreams[1].Retries)
+}
+
+func TestReloadRunningConfig(t *testing.T) {
+	previous := buildTestConfig("NAIVE", "http://test1.com")
+	previous.requestTimeout = 10 * time.Millisecond
+
+	// an invalid config keeps the running one
+	err := reloadRunningConfig(context.Background(), &Config{Strategy: "NAIVE"})
+
+	assert.NotNil(t, err)
+	assert.Same(t, previous, currentRunningConfig())
+
+	err = reloadRunningConfig(context.Background(), &Config{
+		Strategy:  "NAIVE",
+		Upstreams: []*UpstreamConfig{{Url: "http://test1.com"}},
+		Archive:   ArchiveConfig{Upstreams: []*UpstreamConfig{{Url: "http://archive.com"}}, Strategy: "QUORUM"},
+	})
+
+	assert.NotNil(t, err)
+	assert.Same(t, previous, currentRunningConfig())
+	assert.Nil(t, previous.ctx.Err())
+
+	// strategies and upstreams fail the reload instead of panicking
+	err = reloadRunningConfig(context.Background(), &Config{
+		Strategy:  "QUORUM",
+		Upstreams: []*UpstreamConfig{{Url: "http://test1.com"}, {Url: "http://test2.com"}},
+		Quorum:    QuorumConfig{Required: 3},
+	})
+
+	assert.NotNil(t, err)
+	assert.Same(t, previous, currentRunningConfig())
+
+	err = reloadRunningConfig(context.Background(), &Config{Strategy: "NAIVE", Upstreams: []*UpstreamConfig{{Url: "xxx://test1.com"}}})
+
+	assert.NotNil(t, err)
+	assert.Same(t, previous, currentRunningConfig())
+
+	// the previous config is stopped once its requests time out
+	err = reloadRunningConfig(context.Background(), &Config{Strategy: "NAIVE", Upstreams: []*UpstreamConfig{{Url: "http://test2.com"}}})
+
+	assert.Nil(t, err)
+	assert.NotSame(t, previous, currentRunningConfig())
+	assert.Nil(t, currentRunningConfig().ctx.Err())
+	assert.Eventually(t, func() bool { return previous.ctx.Err() != nil }, time.Second, 5*time.Millisecond)
+}
@@ -0,0 +1,154 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HeadTrackerConfig controls how the head block of each upstream is tracked
+type HeadTrackerConfig struct {
+	// http upstreams are polled by eth_blockNumber in this interval,
+	// websocket upstreams only when their newHeads subscription is silent for this long
+	PollIntervalMs int `json:"pollIntervalMs,omitempty"`
+	// an upstream more than this many blocks behind the highest head is lagging, 0 disables it
+	MaxLagBlocks int `json:"maxLagBlocks,omitempty"`
+}
+
+const defaultHeadPollInterval = 5 * time.Second
+
+// headTracker keeps the head block of a group of upstreams up to date,
+// the head is used by archive routing and lagging upstreams are not healthy
+type headTracker struct {
+	config    *HeadTrackerConfig
+	upstreams []Upstream
+}
+
+// the upstreams are polled until ctx is done
+func newHeadTracker(ctx context.Context, cfg *HeadTrackerConfig, upstreams []Upstream) *headTracker {
+	t := &headTracker{
+		config:    cfg,
+		upstreams: upstreams,
+	}
+
+	go t.run(ctx)
+
+	return t
+}
+
+func (t *headTracker) interval() time.Duration {
+	return durationOrDefault(t.config.PollIntervalMs, defaultHeadPollInterval)
+}
+
+// the first poll is one interval after start, websocket upstreams may have pushed their heads by then
+func (t *headTracker) run(ctx context.Context) {
+	ticker := time.NewTicker(t.interval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.poll(ctx)
+		}
+	}
+}
+
+// poll asks the upstreams for their block numbers, except the ones whose newHeads subscription
+// pushed a head within the interval. The failed calls count in their circuit breakers like other requests.
+func (t *headTracker) poll(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	for _, upstream := range t.upstreams {
+		s := upstream.state()
+
+		if !s.isAvailable() || time.Since(s.headPushedAt()) < t.interval() {
+			continue
+		}
+
+		wg.Add(1)
+
+		go func(upstream Upstream) {
+			defer wg.Done()
+
+			bts, err := upstream.handle(ctx, newInternalRequest("eth_blockNumber"))
+
+			var res BlockNumberResponseData
+
+			if err != nil || json.Unmarshal(bts, &res) != nil || res.Result == "" {
+				upstreamLog.Debugf("get block number of %s failed: %v", upstream.state().name, err)
+				return
+			}
+
+			if blockNumber, err := strconv.ParseInt(res.Result, 0, 64); err == nil {
+				upstream.state().setHead(blockNumber)
+			}
+		}(upstream)
+	}
+
+	wg.Wait()
+
+	t.updateLagging()
+}
+
+// head returns the highest block number of the upstreams, 0 if it's unknown
+func (t *headTracker) head() int64 {
+	var head int64
+
+	for _, upstream := range t.upstreams {
+		if blockNumber := atomic.LoadInt64(&upstream.state().blockNumber); blockNumber > head {
+			head = blockNumber
+		}
+	}
+
+	return head
+}
+
+func (t *headTracker) updateLagging() {
+	head := t.head()
+
+	for _, upstream := range t.upstreams {
+		s := upstream.state()
+		blockNumber := atomic.LoadInt64(&s.blockNumber)
+		lagging := t.config.MaxLagBlocks > 0 && blockNumber > 0 && head-blockNumber > int64(t.config.MaxLagBlocks)
+
+		if lagging != s.isLagging() {
+			upstreamLog.Infof("upstream %s lagging: %v, block %d, head %d", s.name, lagging, blockNumber, head)
+		}
+
+		s.setLagging(lagging)
+	}
+}
+
+func (s *upstreamState) setHead(blockNumber int64) {
+	atomic.StoreInt64(&s.blockNumber, blockNumber)
+	upstreamHeadBlock.WithLabelValues(s.name).Set(float64(blockNumber))
+}
+
+// pushHead sets the head received from a newHeads subscription
+func (s *upstreamState) pushHead(blockNumber int64) {
+	s.setHead(blockNumber)
+	atomic.StoreInt64(&s.headPushed, time.Now().UnixNano())
+}
+
+func (s *upstreamState) headPushedAt() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.headPushed))
+}
+
+func (s *upstreamState) setLagging(lagging bool) {
+	var v int32
+
+	if lagging {
+		v = 1
+	}
+
+	atomic.StoreInt32(&s.lagging, v)
+}
+
+func (s *upstreamState) isLagging() bool {
+	return atomic.LoadInt32(&s.lagging) == 1
+}
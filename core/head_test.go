@@ -0,0 +1,110 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeadTrackerPoll(t *testing.T) {
+	var calls1, calls2 int32
+
+	synced := newMethodTestServer(map[string]string{"eth_blockNumber": `"0x10"`}, &calls1)
+	defer synced.Close()
+
+	lagging := newMethodTestServer(map[string]string{"eth_blockNumber": `"0x5"`}, &calls2)
+	defer lagging.Close()
+
+	rcfg := buildTestConfig("FALLBACK", synced.URL, lagging.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracker := newHeadTracker(ctx, &HeadTrackerConfig{PollIntervalMs: 60000, MaxLagBlocks: 3}, rcfg.Upstreams)
+	tracker.poll(context.Background())
+
+	assert.Equal(t, int64(16), tracker.head())
+	assert.Equal(t, int64(5), atomic.LoadInt64(&rcfg.Upstreams[1].state().blockNumber))
+	assert.False(t, rcfg.Upstreams[0].state().isLagging())
+	assert.True(t, rcfg.Upstreams[1].state().isLagging())
+	assert.True(t, rcfg.Upstreams[0].state().isHealthy())
+	assert.False(t, rcfg.Upstreams[1].state().isHealthy())
+
+	// http upstreams are asked on each poll
+	tracker.poll(context.Background())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls1))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls2))
+
+	// a head pushed by a subscription is recent, no need to ask
+	rcfg.Upstreams[0].state().pushHead(17)
+	tracker.poll(context.Background())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls1))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls2))
+}
+
+func TestWsUpstreamNewHeads(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	subscribed := make(chan string, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		_, p, err := conn.ReadMessage()
+
+		if err != nil {
+			return
+		}
+
+		var data RequestData
+		_ = json.Unmarshal(p, &data)
+		subscribed <- data.Method
+
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","id":`+string(mustMarshal(data.ID))+`,"result":"0x1"}`))
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","method":"eth_subscription","params":{"subscription":"0x1","result":{"number":"0x20","hash":"0xabcd"}}}`))
+
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	upstream := newUpstream(ctx, url, &UpstreamConfig{})
+
+	select {
+	case method := <-subscribed:
+		assert.Equal(t, "eth_subscribe", method)
+	case <-time.After(time.Second):
+		t.Fatal("no subscription")
+	}
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(&upstream.state().blockNumber) == 32
+	}, time.Second, 10*time.Millisecond)
+
+	assert.True(t, time.Since(upstream.state().headPushedAt()) < time.Second)
+}
+
+func mustMarshal(v interface{}) []byte {
+	bts, _ := json.Marshal(v)
+	return bts
+}
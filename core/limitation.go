@@ -29,11 +29,11 @@ var DeniedMethod = fmt.Errorf("not allowed method")
 var DeniedContract = fmt.Errorf("not allowed contract or address")
 
 func isAllowedMethod(method string) bool {
-	return currentRunningConfig.allowedMethods[method]
+	return currentRunningConfig().allowedMethods[method]
 }
 
 func inWhitelist(contractAddress string) bool {
-	return currentRunningConfig.allowedCallContracts[strings.ToLower(contractAddress)]
+	return currentRunningConfig().allowedCallContracts[strings.ToLower(contractAddress)]
 }
 
 func isValidCall(req *RequestData) (err error) {
@@ -35,7 +35,7 @@ func TestIsAllowedMethod(t *testing.T) {
 
 	err := json.Unmarshal([]byte(testConfigStr1), config)
 
-	currentRunningConfig, err = BuildRunningConfigFromConfig(ctx, config)
+	_, err = BuildRunningConfigFromConfig(ctx, config)
 
 	if err != nil {
 		logrus.Fatal(err)
@@ -71,7 +71,7 @@ func TestInWhitelist(t *testing.T) {
 
 	err := json.Unmarshal([]byte(testConfigStr2), config)
 
-	currentRunningConfig, err = BuildRunningConfigFromConfig(ctx, config)
+	_, err = BuildRunningConfigFromConfig(ctx, config)
 
 	if err != nil {
 		logrus.Fatal(err)
@@ -107,7 +107,7 @@ func TestIsValidCall(t *testing.T) {
 
 	err := json.Unmarshal([]byte(testConfigStr2), config)
 
-	currentRunningConfig, err = BuildRunningConfigFromConfig(ctx, config)
+	_, err = BuildRunningConfigFromConfig(ctx, config)
 
 	if err != nil {
 		logrus.Fatal(err)
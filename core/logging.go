@@ -0,0 +1,218 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+type LogConfig struct {
+	Level      string            `json:"level"`
+	Format     string            `json:"format"`
+	File       string            `json:"file"`
+	MaxSizeMB  int               `json:"maxSizeMB"`
+	MaxBackups int               `json:"maxBackups"`
+	MaxAgeDays int               `json:"maxAgeDays"`
+	Modules    map[string]string `json:"modules"`
+	Redact     []string          `json:"redactMethods"`
+}
+
+// LogFlags are set by command line flags, they take precedence over the config file
+var LogFlags LogConfig
+
+// params of these methods are never written to logs
+var defaultRedactedMethods = []string{
+	"eth_sendRawTransaction",
+	"eth_sendTransaction",
+	"eth_signTransaction",
+	"eth_sign",
+	"personal_sign",
+	"personal_unlockAccount",
+	"personal_sendTransaction",
+	"personal_signTransaction",
+	"personal_importRawKey",
+	"personal_newAccount",
+}
+
+var moduleLoggers = map[string]*logrus.Logger{}
+
+var (
+	adminLog     = newModuleLogger("admin")
+	configLog    = newModuleLogger("config")
+	monitorLog   = newModuleLogger("monitor")
+	requestLog   = newModuleLogger("request")
+	serverLog    = newModuleLogger("server")
+	strategyLog  = newModuleLogger("strategy")
+	txTrackerLog = newModuleLogger("txtracker")
+	upstreamLog  = newModuleLogger("upstream")
+)
+
+var redactedMethods atomic.Value // map[string]bool
+
+var logFileLock sync.Mutex
+var logFile *lumberjack.Logger
+
+func init() {
+	setRedactedMethods(nil)
+}
+
+func newModuleLogger(module string) *logrus.Entry {
+	logger := logrus.New()
+	moduleLoggers[module] = logger
+	return logger.WithField("module", module)
+}
+
+func setRedactedMethods(extra []string) {
+	methods := make(map[string]bool)
+
+	for _, method := range defaultRedactedMethods {
+		methods[method] = true
+	}
+
+	for _, method := range extra {
+		methods[method] = true
+	}
+
+	redactedMethods.Store(methods)
+}
+
+func isRedactedMethod(method string) bool {
+	return redactedMethods.Load().(map[string]bool)[method]
+}
+
+// redactedBody is the request body safe to be written to logs
+func (r *Request) redactedBody() string {
+	if !isRedactedMethod(r.data.Method) {
+		return string(r.reqBytes)
+	}
+
+	bts, _ := json.Marshal(map[string]interface{}{
+		"jsonrpc": r.data.JsonRpc,
+		"id":      r.data.ID,
+		"method":  r.data.Method,
+		"params":  "[REDACTED]",
+	})
+
+	return string(bts)
+}
+
+func mergeLogConfig(cfg LogConfig, flags LogConfig) LogConfig {
+	if flags.Level != "" {
+		cfg.Level = flags.Level
+	}
+
+	if flags.Format != "" {
+		cfg.Format = flags.Format
+	}
+
+	if flags.File != "" {
+		cfg.File = flags.File
+	}
+
+	if cfg.Level == "" {
+		cfg.Level = "info"
+	}
+
+	return cfg
+}
+
+func logOutput(cfg LogConfig) io.Writer {
+	logFileLock.Lock()
+	defer logFileLock.Unlock()
+
+	if cfg.File == "" {
+		if logFile != nil {
+			_ = logFile.Close()
+			logFile = nil
+		}
+
+		return os.Stdout
+	}
+
+	if logFile == nil || logFile.Filename != cfg.File {
+		if logFile != nil {
+			_ = logFile.Close()
+		}
+
+		logFile = &lumberjack.Logger{Filename: cfg.File}
+	}
+
+	logFile.MaxSize = cfg.MaxSizeMB
+	logFile.MaxBackups = cfg.MaxBackups
+	logFile.MaxAge = cfg.MaxAgeDays
+
+	return logFile
+}
+
+// ApplyLogConfig configures the global logger, module loggers and the access logger.
+// It's called on startup and every time the config file is reloaded.
+func ApplyLogConfig(cfg LogConfig) error {
+	cfg = mergeLogConfig(cfg, LogFlags)
+
+	level, err := logrus.ParseLevel(cfg.Level)
+
+	if err != nil {
+		return err
+	}
+
+	var formatter logrus.Formatter
+
+	switch cfg.Format {
+	case "", "text":
+		formatter = &logrus.TextFormatter{}
+	case "json":
+		formatter = &logrus.JSONFormatter{}
+	default:
+		return fmt.Errorf("unsupported log format: %s", cfg.Format)
+	}
+
+	moduleLevels := make(map[string]logrus.Level)
+
+	for module, l := range cfg.Modules {
+		if _, exist := moduleLoggers[module]; !exist && module != "access" {
+			return fmt.Errorf("unknown log module: %s", module)
+		}
+
+		moduleLevels[module], err = logrus.ParseLevel(l)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	out := logOutput(cfg)
+
+	logrus.SetLevel(level)
+	logrus.SetFormatter(formatter)
+	logrus.SetOutput(out)
+
+	for module, logger := range moduleLoggers {
+		logger.SetFormatter(formatter)
+		logger.SetOutput(out)
+
+		if l, exist := moduleLevels[module]; exist {
+			logger.SetLevel(l)
+		} else {
+			logger.SetLevel(level)
+		}
+	}
+
+	// access log is always json, and enabled unless its level is set above info
+	accessLogger.SetOutput(out)
+
+	if l, exist := moduleLevels["access"]; exist {
+		accessLogger.SetLevel(l)
+	} else {
+		accessLogger.SetLevel(logrus.InfoLevel)
+	}
+
+	setRedactedMethods(cfg.Redact)
+
+	return nil
+}
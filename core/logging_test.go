@@ -0,0 +1,75 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyLogConfig(t *testing.T) {
+	defer func() { _ = ApplyLogConfig(LogConfig{}) }()
+
+	err := ApplyLogConfig(LogConfig{
+		Level:   "warn",
+		Format:  "json",
+		Modules: map[string]string{"upstream": "debug", "access": "error"},
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, logrus.WarnLevel, logrus.GetLevel())
+	assert.Equal(t, logrus.WarnLevel, moduleLoggers["strategy"].GetLevel())
+	assert.Equal(t, logrus.DebugLevel, moduleLoggers["upstream"].GetLevel())
+	assert.Equal(t, logrus.ErrorLevel, accessLogger.GetLevel())
+	assert.IsType(t, &logrus.JSONFormatter{}, moduleLoggers["strategy"].Formatter)
+
+	assert.NotNil(t, ApplyLogConfig(LogConfig{Level: "verbose"}))
+	assert.NotNil(t, ApplyLogConfig(LogConfig{Format: "xml"}))
+	assert.NotNil(t, ApplyLogConfig(LogConfig{Modules: map[string]string{"unknown": "debug"}}))
+}
+
+func TestLogFlagsOverrideConfig(t *testing.T) {
+	defer func() {
+		LogFlags = LogConfig{}
+		_ = ApplyLogConfig(LogConfig{})
+	}()
+
+	LogFlags = LogConfig{Level: "error"}
+
+	assert.Nil(t, ApplyLogConfig(LogConfig{Level: "debug"}))
+	assert.Equal(t, logrus.ErrorLevel, moduleLoggers["config"].GetLevel())
+}
+
+func TestLogFile(t *testing.T) {
+	defer func() { _ = ApplyLogConfig(LogConfig{}) }()
+
+	dir, _ := ioutil.TempDir("", "gateway-log")
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "gateway.log")
+
+	assert.Nil(t, ApplyLogConfig(LogConfig{File: file, MaxSizeMB: 10}))
+	configLog.Info("hello log file")
+
+	bts, err := ioutil.ReadFile(file)
+	assert.Nil(t, err)
+	assert.Contains(t, string(bts), "hello log file")
+}
+
+func TestRedactedBody(t *testing.T) {
+	buildTestConfig("NAIVE", "http://test1.com")
+
+	req, _ := newRequest([]byte(`{"params": ["0xf86b80"], "method": "eth_sendRawTransaction", "id": 1, "jsonrpc": "2.0"}`))
+	assert.NotContains(t, req.redactedBody(), "0xf86b80")
+	assert.Contains(t, req.redactedBody(), "eth_sendRawTransaction")
+
+	req, _ = newRequest([]byte(`{"params": ["0x1", "latest"], "method": "eth_getBalance", "id": 1, "jsonrpc": "2.0"}`))
+	assert.Contains(t, req.redactedBody(), "0x1")
+
+	defer setRedactedMethods(nil)
+	setRedactedMethods([]string{"eth_getBalance"})
+	assert.NotContains(t, req.redactedBody(), "0x1")
+}
@@ -2,48 +2,211 @@ package core
 
 import (
 	"context"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/sirupsen/logrus"
+	"errors"
+	"net"
 	"net/http"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-var counter *prometheus.CounterVec
-var gauge *prometheus.GaugeVec
-var histogram *prometheus.HistogramVec
+const metricsNamespace = "jsonrpc_gateway"
+
+// request outcomes
+const (
+	outcomeSuccess    = "success"
+	outcomeRpcError   = "rpc_error"
+	outcomeFailure    = "failure"
+	outcomeDenied     = "denied"
+	outcomeBadRequest = "bad_request"
+	outcomeCancelled  = "cancelled"
+)
+
+// buckets in seconds, from a cached response to a slow archive node call
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "Total number of client requests.",
+	}, []string{"method", "upstream", "strategy", "outcome"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_duration_seconds",
+		Help:      "Latency of client requests.",
+		Buckets:   latencyBuckets,
+	}, []string{"method", "upstream", "strategy", "outcome"})
+
+	upstreamRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Latency of requests sent to upstreams.",
+		Buckets:   latencyBuckets,
+	}, []string{"upstream"})
+
+	upstreamErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_errors_total",
+		Help:      "Total number of failed upstream requests by kind of error.",
+	}, []string{"upstream", "kind"})
+
+	clientWebsocketConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "client_websocket_connections",
+		Help:      "Number of open websocket connections from clients.",
+	})
+
+	upstreamWebsocketConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_websocket_connections",
+		Help:      "Number of open websocket connections to upstreams.",
+	}, []string{"upstream"})
+
+	clientWebsocketRejectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "client_websocket_rejections_total",
+		Help:      "Total number of client websocket connections rejected, by the reason.",
+	}, []string{"reason"})
+
+	upstreamHeadBlock = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_head_block",
+		Help:      "Latest block number of each upstream.",
+	}, []string{"upstream"})
+
+	upstreamCircuitState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_circuit_state",
+		Help:      "Circuit breaker state of upstreams, 0 closed, 1 half-open, 2 open.",
+	}, []string{"upstream"})
+
+	upstreamCircuitTransitionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_circuit_transitions_total",
+		Help:      "Total number of circuit breaker state changes by the new state.",
+	}, []string{"upstream", "state"})
+
+	raceWinsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "race_wins_total",
+		Help:      "Total number of races won by each upstream.",
+	}, []string{"upstream"})
+
+	hedgeRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "hedge_requests_total",
+		Help:      "Total number of hedged requests sent to each upstream after the hedge delay.",
+	}, []string{"upstream"})
+
+	quorumDivergencesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "quorum_divergences_total",
+		Help:      "Total number of requests whose upstreams didn't reach a quorum.",
+	}, []string{"method"})
+
+	policyDenialsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "policy_denials_total",
+		Help:      "Total number of requests denied by method limitation.",
+	}, []string{"reason"})
+
+	archiveRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "archive_requests_total",
+		Help:      "Total number of requests sent to archive upstreams, by the reason.",
+	}, []string{"reason"})
+
+	trackedTransactions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "tracked_transactions",
+		Help:      "Number of transactions tracked by the gateway in each status.",
+	}, []string{"status"})
+
+	txRebroadcastsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tx_rebroadcasts_total",
+		Help:      "Total number of pending transactions sent to upstreams again.",
+	})
+)
 
 func init() {
-	histogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Name: "histogram",
-		Help: "histogram",
-	}, []string{"key"})
-
-	counter = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "counter",
-		Help: "counter",
-	}, []string{"key"})
-
-	gauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "gauge",
-		Help: "gauge",
-	}, []string{"key"})
-
-	prometheus.MustRegister(counter)
-	prometheus.MustRegister(gauge)
-	prometheus.MustRegister(histogram)
+	prometheus.MustRegister(
+		requestsTotal,
+		requestDuration,
+		upstreamRequestDuration,
+		upstreamErrorsTotal,
+		clientWebsocketConnections,
+		upstreamWebsocketConnections,
+		clientWebsocketRejectionsTotal,
+		upstreamHeadBlock,
+		upstreamCircuitState,
+		upstreamCircuitTransitionsTotal,
+		raceWinsTotal,
+		hedgeRequestsTotal,
+		quorumDivergencesTotal,
+		policyDenialsTotal,
+		archiveRequestsTotal,
+		trackedTransactions,
+		txRebroadcastsTotal,
+	)
+}
+
+func observeRequest(method, upstream, strategy, outcome string, startAt time.Time) {
+	requestsTotal.WithLabelValues(method, upstream, strategy, outcome).Inc()
+	requestDuration.WithLabelValues(method, upstream, strategy, outcome).Observe(time.Since(startAt).Seconds())
 }
 
-func Time(key string, value float64) {
-	histogram.WithLabelValues(key).Observe(value)
+func observeUpstreamRequest(upstream string, startAt time.Time, err error) {
+	upstreamRequestDuration.WithLabelValues(upstream).Observe(time.Since(startAt).Seconds())
+
+	if err != nil {
+		upstreamErrorsTotal.WithLabelValues(upstream, upstreamErrorKind(err)).Inc()
+	}
 }
 
-func Count(key string) {
-	counter.WithLabelValues(key).Inc()
+func upstreamErrorKind(err error) string {
+	if err == TimeoutError {
+		return "timeout"
+	}
+
+	// losing race legs and requests abandoned by clients
+	if errors.Is(err, context.Canceled) {
+		return "cancelled"
+	}
+
+	if err == RateLimitedError {
+		return "rate_limited"
+	}
+
+	if errors.Is(err, InvalidResponseError) {
+		return "invalid_response"
+	}
+
+	if err == ConnectionLostError {
+		return "connection_lost"
+	}
+
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return "timeout"
+	}
+
+	return "transport"
 }
 
-func Value(key string, value float64) {
-	gauge.WithLabelValues(key).Set(value)
+func policyDenialReason(err error) string {
+	switch err {
+	case DeniedMethod:
+		return "method"
+	case DeniedContract:
+		return "contract"
+	case DecodeError:
+		return "decode"
+	default:
+		return "unknown"
+	}
 }
 
 func Handler() http.Handler {
@@ -65,15 +228,15 @@ func StartMonitorHttpServer(ctx context.Context) {
 		defer cancel()
 
 		if err := hs.Shutdown(shutdownCtx); err != nil {
-			logrus.Fatalf("Could not gracefully shutdown metric server: %v\n", err)
+			monitorLog.Fatalf("Could not gracefully shutdown metric server: %v\n", err)
 		}
 	}()
 
-	logrus.Infof("metrics server listen on %s", addr)
+	monitorLog.Infof("metrics server listen on %s", addr)
 
 	if err := hs.ListenAndServe(); err != nil {
 		if err != http.ErrServerClosed {
-			logrus.Errorf("Listen failed %v", err)
+			monitorLog.Errorf("Listen failed %v", err)
 		}
 	}
 }
@@ -0,0 +1,52 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type testTimeoutError struct{}
+
+func (e testTimeoutError) Error() string   { return "i/o timeout" }
+func (e testTimeoutError) Timeout() bool   { return true }
+func (e testTimeoutError) Temporary() bool { return true }
+
+func TestUpstreamErrorKind(t *testing.T) {
+	assert.Equal(t, "timeout", upstreamErrorKind(TimeoutError))
+	assert.Equal(t, "timeout", upstreamErrorKind(testTimeoutError{}))
+	assert.Equal(t, "transport", upstreamErrorKind(fmt.Errorf("connection refused")))
+	assert.Equal(t, "cancelled", upstreamErrorKind(context.Canceled))
+}
+
+func TestPolicyDenialReason(t *testing.T) {
+	assert.Equal(t, "method", policyDenialReason(DeniedMethod))
+	assert.Equal(t, "contract", policyDenialReason(DeniedContract))
+	assert.Equal(t, "decode", policyDenialReason(DecodeError))
+}
+
+func TestObserveRequest(t *testing.T) {
+	before := testutil.ToFloat64(requestsTotal.WithLabelValues("eth_blockNumber", "http://test1.com", "NAIVE", outcomeSuccess))
+	observeRequest("eth_blockNumber", "http://test1.com", "NAIVE", outcomeSuccess, time.Now())
+	after := testutil.ToFloat64(requestsTotal.WithLabelValues("eth_blockNumber", "http://test1.com", "NAIVE", outcomeSuccess))
+
+	assert.Equal(t, before+1, after)
+}
+
+func TestObserveUpstreamRequest(t *testing.T) {
+	u, _ := url.Parse("http://monitor.test.com/v3/secret")
+	s := newUpstreamState(u, &UpstreamConfig{})
+
+	assert.Equal(t, "http://monitor.test.com", s.name)
+
+	req := getBlockNumberRequest()
+	_, done, _ := s.begin(context.Background(), req)
+	done(TimeoutError)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(upstreamErrorsTotal.WithLabelValues(s.name, "timeout")))
+}
@@ -1,9 +1,9 @@
 package core
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"strconv"
 	"time"
 
 	"github.com/HydroProtocol/ethereum-jsonrpc-gateway/utils"
@@ -12,12 +12,22 @@ import (
 
 var TimeoutError = fmt.Errorf("timeout error")
 var AllUpstreamsFailedError = fmt.Errorf("all upstream requests are failed")
+var NoValidUpstreamError = fmt.Errorf("no valid upstream")
+var CircuitOpenError = fmt.Errorf("upstream circuit is open")
+var QuorumNotReachedError = fmt.Errorf("upstreams don't agree on the result")
+var RateLimitedError = fmt.Errorf("upstream rate limited")
+var InvalidResponseError = fmt.Errorf("invalid upstream response")
+var ConnectionLostError = fmt.Errorf("upstream connection lost")
 
 type Request struct {
+	id                   string
 	logger               *logrus.Entry
 	data                 *RequestData
 	reqBytes             []byte
 	isArchiveDataRequest bool
+	upstream             string   // name of the upstream which served the request
+	served               Upstream // the upstream which served the request, names of upstreams on one host are the same
+	clientKey            string   // identifies the client for sticky sessions
 }
 
 func getBlockNumberRequest() *Request {
@@ -25,68 +35,70 @@ func getBlockNumberRequest() *Request {
 	return res
 }
 
-func (r *Request) isOldTrieRequest(currentBlockNumber int) (res bool) {
+func (r *Request) setUpstream(upstream Upstream) {
+	r.served = upstream
+	r.upstream = upstream.state().name
+}
+
+// isOldTrieRequest tells whether the request reads state older than threshold blocks,
+// it's false for methods not reading the state at a block
+func (r *Request) isOldTrieRequest(currentBlockNumber, threshold int) (res bool) {
 	defer func() {
 		r.isArchiveDataRequest = res
 	}()
 
-	if currentBlockNumber == 0 {
-		res = false
-		return
+	index, ok := stateAtBlockMethods[r.data.Method]
+
+	// the block param is optional, the default is latest
+	if !ok || len(r.data.Params) <= index {
+		return false
 	}
 
-	method := r.data.Method
+	return isArchiveBlockParam(r.data.Params[index], currentBlockNumber, threshold)
+}
 
-	if method != "eth_call" && method != "eth_getBalance" {
-		res = false
-		return
+// newInternalRequest builds a request sent by the gateway itself, it's not limited by the method limitation
+func newInternalRequest(method string, params ...interface{}) *Request {
+	if params == nil {
+		params = []interface{}{}
 	}
 
-	if len(r.data.Params) != 2 {
-		res = false
-		return
-	}
+	id := utils.RandStringRunes(8)
+	data := &RequestData{JsonRpc: "2.0", ID: time.Now().UnixNano(), Method: method, Params: params}
+	bts, _ := json.Marshal(data)
 
-	reqBlockNumber := r.data.Params[1]
-
-	switch v := reqBlockNumber.(type) {
-	case string:
-		if v == "latest" || v == "pending" {
-			res = false
-			return
-		}
-		n, _ := strconv.ParseInt(v, 0, 64)
-		res = currentBlockNumber-int(n) > 100
-	case int:
-		logrus.Errorf("unknown %d", currentBlockNumber)
-		res = currentBlockNumber-v > 100
-	case float64:
-		logrus.Errorf("unknown %d", currentBlockNumber)
-		res = currentBlockNumber-int(v) > 100
-	default:
-		logrus.Errorf("unknown blocknumber %+v", v)
-		res = false
+	return &Request{
+		id:       id,
+		logger:   requestLog.WithFields(logrus.Fields{"request_id": id}),
+		data:     data,
+		reqBytes: bts,
 	}
-	return
 }
 
 func newRequest(reqBodyBytes []byte) (*Request, error) {
-	logger := logrus.WithFields(logrus.Fields{"request_id": utils.RandStringRunes(8)})
+	return newRequestWithContext(context.Background(), utils.RandStringRunes(8), reqBodyBytes)
+}
+
+func newRequestWithContext(ctx context.Context, id string, reqBodyBytes []byte) (*Request, error) {
+	logger := requestLog.WithFields(logrus.Fields{"request_id": id})
 
 	var data RequestData
 	_ = json.Unmarshal(reqBodyBytes, &data)
 
 	logger.Debugf("New, method: %s\n", data.Method)
-	logger.Debugf("Request Body: %s\n", string(reqBodyBytes))
-
 	req := &Request{
+		id:       id,
 		logger:   logger,
 		data:     &data,
 		reqBytes: reqBodyBytes,
 	}
 
+	logger.Debugf("Request Body: %s\n", req.redactedBody())
+
 	// method limit, for directly external access
+	_, span := startSpan(ctx, "jsonrpc.validate")
 	err := req.valid()
+	endSpan(span, err)
 
 	if err != nil {
 		return req, err
@@ -97,7 +109,7 @@ func newRequest(reqBodyBytes []byte) (*Request, error) {
 
 func (r *Request) valid() error {
 
-	if !currentRunningConfig.MethodLimitationEnabled {
+	if !currentRunningConfig().MethodLimitationEnabled {
 		return nil
 	}
 
@@ -105,6 +117,7 @@ func (r *Request) valid() error {
 
 	if err != nil {
 		r.logger.Printf("not valid, skip\n")
+		policyDenialsTotal.WithLabelValues(policyDenialReason(err)).Inc()
 		return err
 	}
 
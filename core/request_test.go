@@ -31,8 +31,8 @@ func TestIsOldTrieRequest(t *testing.T) {
 		reqBytes: reqBodyBytes1,
 	}
 
-	assert.Equal(t, false, req1.isOldTrieRequest(0))
-	assert.Equal(t, false, req1.isOldTrieRequest(1))
+	assert.Equal(t, false, req1.isOldTrieRequest(0, 100))
+	assert.Equal(t, false, req1.isOldTrieRequest(1, 100))
 
 	reqBodyBytes2 := []byte(fmt.Sprintf(`{"params": [], "method": "eth_call", "id": %d, "jsonrpc": "2.0"}`, time.Now().Unix()))
 
@@ -45,7 +45,7 @@ func TestIsOldTrieRequest(t *testing.T) {
 		reqBytes: reqBodyBytes2,
 	}
 
-	assert.Equal(t, false, req2.isOldTrieRequest(1))
+	assert.Equal(t, false, req2.isOldTrieRequest(1, 100))
 
 	reqBodyBytes3 := []byte(fmt.Sprintf(`{"params": ["testParams0", "1"], "method": "eth_call", "id": %d, "jsonrpc": "2.0"}`, time.Now().Unix()))
 
@@ -58,7 +58,7 @@ func TestIsOldTrieRequest(t *testing.T) {
 		reqBytes: reqBodyBytes3,
 	}
 
-	assert.Equal(t, true, req3.isOldTrieRequest(10000))
+	assert.Equal(t, true, req3.isOldTrieRequest(10000, 100))
 	reqBodyBytes4 := []byte(fmt.Sprintf(`{"params": [1, 1], "method": "eth_call", "id": %d, "jsonrpc": "2.0"}`, time.Now().Unix()))
 
 	var data4 RequestData
@@ -70,7 +70,7 @@ func TestIsOldTrieRequest(t *testing.T) {
 		reqBytes: reqBodyBytes4,
 	}
 
-	assert.Equal(t, true, req4.isOldTrieRequest(10000))
+	assert.Equal(t, true, req4.isOldTrieRequest(10000, 100))
 }
 
 func TestNewRequest(t *testing.T) {
@@ -110,7 +110,7 @@ func TestValid(t *testing.T) {
 
 	err := json.Unmarshal([]byte(testConfigStr1), config)
 
-	currentRunningConfig, err = BuildRunningConfigFromConfig(ctx, config)
+	_, err = BuildRunningConfigFromConfig(ctx, config)
 
 	if err != nil {
 		logrus.Fatal(err)
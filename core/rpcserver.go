@@ -1,36 +1,44 @@
 package core
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/HydroProtocol/ethereum-jsonrpc-gateway/utils"
 	"github.com/gorilla/websocket"
-	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var httpClient *http.Client
+var methodNamePattern = regexp.MustCompile(`^[a-zA-Z0-9]+_[a-zA-Z0-9]+$`)
 
 const (
 	maxIdleConnections int = 200
-	requestTimeout     int = 10
 )
 
 func init() {
-	httpClient = createHTTPClient()
 	rand.Seed(time.Now().UnixNano())
 }
 
-// createHTTPClient for connection re-use
-func createHTTPClient() *http.Client {
-	return &http.Client{
-		Transport: &http.Transport{
-			MaxIdleConnsPerHost: maxIdleConnections,
-		},
-		Timeout: time.Duration(requestTimeout) * time.Second,
+// createHTTPClient for connection re-use, the request timeout is set by the request context
+func createHTTPClient(cfg *UpstreamConfig) (*http.Client, error) {
+	transport, err := newHttpTransport(cfg)
+
+	if err != nil {
+		return nil, err
 	}
+
+	return &http.Client{Transport: transport}, nil
 }
 
 type Server struct{}
@@ -39,46 +47,260 @@ var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
 	CheckOrigin: func(r *http.Request) bool {
-		return true
+		return currentRunningConfig().config.Websocket.checkOrigin(r)
 	},
 }
 
-func (h *Server) ServerWS(conn *websocket.Conn) error {
+type wsReply struct {
+	messageType int
+	bts         chan []byte
+}
+
+// ServerWS handles the requests of a websocket connection at the same time, up to the max in flight,
+// and replies in order or once a reply is ready. A denied request is answered with an error.
+func (h *Server) ServerWS(conn *websocket.Conn, upgradeRequest *http.Request) error {
 	defer conn.Close()
 
-	for {
-		messageType, r, err := conn.NextReader()
-		if err != nil {
-			return err
+	cfg := currentRunningConfig().config.Websocket
+
+	// cancelled when the connection is closed
+	connCtx, cancel := context.WithCancel(upgradeRequest.Context())
+	defer cancel()
+
+	var writeLock sync.Mutex
+
+	write := func(messageType int, bts []byte) {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+
+		if err := conn.WriteMessage(messageType, bts); err != nil {
+			serverLog.Debugf("write to ws client failed: %v", err)
+			cancel()
 		}
+	}
 
-		w, err := conn.NextWriter(messageType)
+	// a dead client is disconnected when neither the pong nor a request is received in time
+	pingInterval := durationOrDefault(cfg.PingIntervalMs, defaultWsPingInterval)
+	extendReadDeadline := func() error {
+		return conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+	}
 
-		if err != nil {
-			return err
+	_ = extendReadDeadline()
+	conn.SetPongHandler(func(string) error { return extendReadDeadline() })
+
+	lastRequestAt := time.Now().UnixNano()
+
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+
+		var idleTicker <-chan time.Time
+
+		if cfg.IdleTimeoutMs > 0 {
+			t := time.NewTicker(time.Duration(cfg.IdleTimeoutMs) * time.Millisecond / 2)
+			defer t.Stop()
+			idleTicker = t.C
 		}
 
-		reqBodyBytes, _ := ioutil.ReadAll(r)
-		proxyRequest, err := newRequest(reqBodyBytes)
+		for {
+			select {
+			case <-connCtx.Done():
+				return
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pingInterval)); err != nil {
+					cancel()
+				}
+			case <-idleTicker:
+				if time.Since(time.Unix(0, atomic.LoadInt64(&lastRequestAt))) > time.Duration(cfg.IdleTimeoutMs)*time.Millisecond {
+					serverLog.Debugf("ws client %s is idle, disconnect", clientIP(upgradeRequest))
+					_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "idle timeout"), time.Now().Add(time.Second))
+					cancel()
+				}
+			}
+		}
+	}()
+
+	// the reader stops when the connection is cancelled
+	go func() {
+		<-connCtx.Done()
+		_ = conn.SetReadDeadline(time.Now())
+	}()
+
+	slots := make(chan struct{}, intOrDefault(cfg.MaxInFlight, defaultWsMaxInFlight))
+
+	// replies of ordered connections are written by one goroutine in the order of the requests
+	var replies chan *wsReply
+
+	if cfg.Ordered {
+		replies = make(chan *wsReply, cap(slots))
+		defer close(replies)
+
+		go func() {
+			for reply := range replies {
+				write(reply.messageType, <-reply.bts)
+			}
+		}()
+	}
+
+	// the requests in flight are cancelled once the connection is closed
+	var handlers sync.WaitGroup
+
+	defer func() {
+		cancel()
+		handlers.Wait()
+	}()
+
+	for {
+		messageType, reqBodyBytes, err := conn.ReadMessage()
 
 		if err != nil {
 			return err
 		}
 
-		bts, err := currentRunningConfig.Strategy.handle(proxyRequest)
+		_ = extendReadDeadline()
+		atomic.StoreInt64(&lastRequestAt, time.Now().UnixNano())
 
-		if err != nil {
-			bts = getErrorResponseBytes(proxyRequest.data.ID, err.Error())
+		select {
+		case slots <- struct{}{}:
+		case <-connCtx.Done():
+			return connCtx.Err()
 		}
 
-		if _, err := w.Write(bts); err != nil {
-			return err
+		var reply *wsReply
+
+		if replies != nil {
+			reply = &wsReply{messageType, make(chan []byte, 1)}
+			replies <- reply
 		}
 
-		if err := w.Close(); err != nil {
-			return err
+		handlers.Add(1)
+
+		go func() {
+			defer handlers.Done()
+			defer func() { <-slots }()
+
+			bts := h.handleWsMessage(connCtx, upgradeRequest, reqBodyBytes)
+
+			if reply != nil {
+				reply.bts <- bts
+				return
+			}
+
+			write(messageType, bts)
+		}()
+	}
+}
+
+// handleWsMessage returns the reply of a websocket request, an error response if it's denied or failed
+func (h *Server) handleWsMessage(connCtx context.Context, upgradeRequest *http.Request, reqBodyBytes []byte) []byte {
+	accessLog := newAccessLogEntry("ws", upgradeRequest)
+	defer accessLog.write()
+
+	ctx, span := startSpan(connCtx, "jsonrpc.request", trace.WithSpanKind(trace.SpanKindServer))
+	proxyRequest, err := newRequestWithContext(ctx, requestID(nil), reqBodyBytes)
+	span.SetAttributes(attribute.String("rpc.method", proxyRequest.data.Method))
+	accessLog.request = proxyRequest
+
+	if err != nil {
+		endSpan(span, err)
+		observeRequest("", "", "", outcomeDenied, accessLog.startAt)
+		accessLog.status = http.StatusInternalServerError
+		accessLog.err = err
+
+		bts := getErrorResponseBytes(proxyRequest.data.ID, err.Error())
+		accessLog.bytes = len(bts)
+
+		return bts
+	}
+
+	proxyRequest.clientKey = currentRunningConfig().config.StickySession.key(upgradeRequest)
+
+	strategyName, bts, err := dispatch(ctx, proxyRequest)
+	endSpan(span, err)
+	observeRequest(metricMethodLabel(proxyRequest.data.Method), proxyRequest.upstream, strategyName, responseOutcome(bts, err), accessLog.startAt)
+
+	accessLog.status = http.StatusOK
+
+	if err != nil {
+		bts = getErrorResponseBytes(proxyRequest.data.ID, err.Error())
+		accessLog.status = http.StatusInternalServerError
+		accessLog.err = err
+	}
+
+	accessLog.bytes = len(bts)
+
+	return bts
+}
+
+// dispatch proxies a valid request with the running strategy,
+// the upstream calls are cancelled when ctx is done or the request deadline is exceeded
+func dispatch(ctx context.Context, req *Request) (string, []byte, error) {
+	rcfg := currentRunningConfig()
+	strategyName, strategy := rcfg.getStrategy()
+
+	ctx, cancel := context.WithTimeout(ctx, rcfg.requestTimeout)
+	defer cancel()
+
+	ctx, span := startSpan(ctx, "strategy."+strings.ToLower(strategyName))
+
+	handle := requestHandler(strategy.handle)
+
+	if rcfg.broadcaster.methods[req.data.Method] {
+		handle = rcfg.broadcaster.handle
+	} else if sessions := rcfg.sessions; sessions != nil && req.clientKey != "" {
+		handle = func(ctx context.Context, req *Request) ([]byte, error) {
+			return sessions.handle(ctx, req, strategy)
 		}
 	}
+
+	if archive := rcfg.archive; archive != nil && !rcfg.broadcaster.methods[req.data.Method] {
+		next := handle
+		handle = func(ctx context.Context, req *Request) ([]byte, error) {
+			return archive.handle(ctx, req, next)
+		}
+	}
+
+	var bts []byte
+	var err error
+
+	if routes := rcfg.txRoutes; routes != nil {
+		bts, err = routes.handle(ctx, req, handle)
+	} else {
+		bts, err = handle(ctx, req)
+	}
+
+	if tracker := rcfg.txTracker; tracker != nil && req.data.Method == "eth_sendRawTransaction" && err == nil && classifyResponse(bts, nil) == responseSuccess {
+		tracker.track(req, bts)
+	}
+
+	endSpan(span, err)
+
+	return strategyName, bts, err
+}
+
+func responseOutcome(bts []byte, err error) string {
+	if err == context.Canceled {
+		return outcomeCancelled
+	}
+
+	if err != nil {
+		return outcomeFailure
+	}
+
+	if !utils.NoErrorFieldInJSON(string(bts)) {
+		return outcomeRpcError
+	}
+
+	return outcomeSuccess
+}
+
+// method names come from clients, keep only the well formed ones as metric label
+func metricMethodLabel(method string) string {
+	if len(method) > 64 || !methodNamePattern.MatchString(method) {
+		return "invalid"
+	}
+
+	return method
 }
 
 func getErrorResponseBytes(id interface{}, reason interface{}) []byte {
@@ -96,67 +318,104 @@ func getErrorResponseBytes(id interface{}, reason interface{}) []byte {
 
 func (h *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if req.URL.Path == "/ws" {
+		cfg := &currentRunningConfig().config.Websocket
+
+		if !cfg.checkOrigin(req) {
+			clientWebsocketRejectionsTotal.WithLabelValues("origin").Inc()
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+
+		release, reason := acquireWsConnection(cfg, req)
+
+		if release == nil {
+			clientWebsocketRejectionsTotal.WithLabelValues(reason).Inc()
+			http.Error(w, "too many connections", http.StatusTooManyRequests)
+			return
+		}
+
+		defer release()
+
 		conn, err := upgrader.Upgrade(w, req, nil)
 
 		if err != nil {
-			logrus.Error(err)
+			serverLog.Error(err)
 			return
 		}
 
-		_ = h.ServerWS(conn)
+		clientWebsocketConnections.Inc()
+		_ = h.ServerWS(conn, req)
+		clientWebsocketConnections.Dec()
 		return
 	}
 
+	id := requestID(req)
+
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, "+requestIDHeader)
+	w.Header().Set("Access-Control-Expose-Headers", requestIDHeader)
 	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set(requestIDHeader, id)
 
 	if req.Method == http.MethodOptions {
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
+	accessLog := newAccessLogEntry("http", req)
+	defer accessLog.write()
+
 	if req.Method != http.MethodPost {
 		w.WriteHeader(400)
-		_, _ = w.Write([]byte("Method Should Be POST"))
-		Count("bad_request")
+		accessLog.bytes, _ = w.Write([]byte("Method Should Be POST"))
+		accessLog.status = 400
+		observeRequest("", "", "", outcomeBadRequest, time.Now())
 		return
 	}
 
-	startTime := time.Now()
 	reqBodyBytes, _ := ioutil.ReadAll(req.Body)
-	proxyRequest, err := newRequest(reqBodyBytes)
+
+	ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	ctx, span := startSpan(ctx, "jsonrpc.request", trace.WithSpanKind(trace.SpanKindServer))
+	proxyRequest, err := newRequestWithContext(ctx, id, reqBodyBytes)
+	span.SetAttributes(attribute.String("rpc.method", proxyRequest.data.Method))
+	defer func() { endSpan(span, err) }()
+
+	accessLog.request = proxyRequest
 
 	if err != nil {
 		w.WriteHeader(500)
-		_, _ = w.Write(getErrorResponseBytes(proxyRequest.data.ID, err.Error()))
-		logrus.Errorf("Req from %s %s 500 %s", req.RemoteAddr, proxyRequest.data.Method, err.Error())
+		accessLog.bytes, _ = w.Write(getErrorResponseBytes(proxyRequest.data.ID, err.Error()))
+		accessLog.status = 500
+		accessLog.err = err
+		observeRequest("", "", "", outcomeDenied, accessLog.startAt)
 		return
 	}
 
-	defer func(){
-		costInMs := time.Since(startTime).Nanoseconds() / 1000000
+	proxyRequest.clientKey = currentRunningConfig().config.StickySession.key(req)
+
+	strategyName, bts, err := dispatch(ctx, proxyRequest)
+
+	defer func() {
+		costInMs := time.Since(accessLog.startAt).Nanoseconds() / 1000000
 		if costInMs > 5000 {
-			logrus.Infof("slow request, method: %s, cost: %d", proxyRequest.data.Method, costInMs)
+			proxyRequest.logger.Infof("slow request, method: %s, cost: %d", proxyRequest.data.Method, costInMs)
 		}
-		Time(proxyRequest.data.Method, float64(costInMs))
+		observeRequest(metricMethodLabel(proxyRequest.data.Method), proxyRequest.upstream, strategyName, responseOutcome(bts, err), accessLog.startAt)
 	}()
 
-	bts, err := currentRunningConfig.Strategy.handle(proxyRequest)
-
-	var isArchiveRequestText string
 	if proxyRequest.isArchiveDataRequest {
-		isArchiveRequestText = "(ArchiveData)"
-		logrus.Info(string(proxyRequest.reqBytes))
+		proxyRequest.logger.Debugf("archive data request: %s", proxyRequest.redactedBody())
 	}
 
 	if err != nil {
 		w.WriteHeader(500)
-		_, _ = w.Write(getErrorResponseBytes(proxyRequest.data.ID, err.Error()))
-		logrus.Errorf("Req%s from %s %s 500 %s", isArchiveRequestText, req.RemoteAddr, proxyRequest.data.Method, err.Error())
+		accessLog.bytes, _ = w.Write(getErrorResponseBytes(proxyRequest.data.ID, err.Error()))
+		accessLog.status = 500
+		accessLog.err = err
 		return
 	}
 
-	_, _ = w.Write(bts)
-	logrus.Infof("Req%s from %s %s 200", isArchiveRequestText, req.RemoteAddr, proxyRequest.data.Method)
+	accessLog.bytes, _ = w.Write(bts)
+	accessLog.status = 200
 }
@@ -11,7 +11,10 @@ import (
 )
 
 func TestCreateHTTPClient(t *testing.T) {
-	assert.IsType(t, &http.Client{}, createHTTPClient())
+	client, err := createHTTPClient(&UpstreamConfig{})
+
+	assert.Nil(t, err)
+	assert.IsType(t, &http.Client{}, client)
 }
 
 func TestGetErrorResponseBytes(t *testing.T) {
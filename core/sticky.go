@@ -0,0 +1,155 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// StickySessionConfig makes the requests of a client go to the same upstream,
+// so the pending state and nonces it sees are consistent
+type StickySessionConfig struct {
+	// apiKey, ip or header, sticky sessions are disabled if empty
+	By string `json:"by"`
+	// name of the header identifying the client, when by is header
+	Header string `json:"header,omitempty"`
+	// a session expires if the client sends no request in this window
+	WindowMs int `json:"windowMs,omitempty"`
+}
+
+const defaultStickySessionWindow = time.Minute
+
+func (c *StickySessionConfig) validate() error {
+	switch c.By {
+	case "", "apiKey", "ip":
+		return nil
+	case "header":
+		if c.Header == "" {
+			return fmt.Errorf("sticky session by header requires the header name")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported sticky session by: %s", c.By)
+	}
+}
+
+// key identifies the client of the request, empty if sticky sessions are disabled
+func (c *StickySessionConfig) key(req *http.Request) string {
+	switch c.By {
+	case "apiKey":
+		return clientAPIKey(req)
+	case "ip":
+		return clientIP(req)
+	case "header":
+		return req.Header.Get(c.Header)
+	default:
+		return ""
+	}
+}
+
+type stickySession struct {
+	upstream Upstream
+	expireAt time.Time
+}
+
+type stickySessions struct {
+	lock     sync.Mutex
+	window   time.Duration
+	sessions map[string]*stickySession
+}
+
+// the expired sessions are removed until ctx is done
+func newStickySessions(ctx context.Context, window time.Duration) *stickySessions {
+	s := &stickySessions{
+		window:   window,
+		sessions: make(map[string]*stickySession),
+	}
+
+	go func() {
+		ticker := time.NewTicker(s.window)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				s.removeExpired(now)
+			}
+		}
+	}()
+
+	return s
+}
+
+func (s *stickySessions) get(key string) Upstream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	session, exist := s.sessions[key]
+
+	if !exist || time.Now().After(session.expireAt) {
+		return nil
+	}
+
+	return session.upstream
+}
+
+func (s *stickySessions) set(key string, upstream Upstream) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.sessions[key] = &stickySession{upstream, time.Now().Add(s.window)}
+}
+
+func (s *stickySessions) remove(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.sessions, key)
+}
+
+func (s *stickySessions) removeExpired(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for key, session := range s.sessions {
+		if now.After(session.expireAt) {
+			delete(s.sessions, key)
+		}
+	}
+}
+
+// handle sends the request to the upstream of the client session while it's healthy,
+// otherwise the strategy chooses an upstream and the session sticks to it
+func (s *stickySessions) handle(ctx context.Context, req *Request, strategy IStrategy) ([]byte, error) {
+	if upstream := s.get(req.clientKey); upstream != nil {
+		if upstream.state().isHealthy() {
+			req.setUpstream(upstream)
+			bts, err := upstream.handle(ctx, req)
+
+			if ctx.Err() != nil {
+				return nil, contextError(ctx)
+			}
+
+			if classifyResponse(bts, err).isFinal() {
+				s.set(req.clientKey, upstream)
+				return bts, nil
+			}
+
+			req.logger.Infof("sticky upstream %s failed: %v, fall over", upstream.state().name, err)
+		}
+
+		s.remove(req.clientKey)
+	}
+
+	bts, err := strategy.handle(ctx, req)
+
+	if err == nil && req.served != nil && classifyResponse(bts, nil).isFinal() {
+		s.set(req.clientKey, req.served)
+	}
+
+	return bts, err
+}
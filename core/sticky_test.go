@@ -0,0 +1,116 @@
+package core
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStickySessionKey(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/?apiKey=query-key", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Wallet", "wallet-1")
+
+	assert.Equal(t, "", (&StickySessionConfig{}).key(req))
+	assert.Equal(t, "query-key", (&StickySessionConfig{By: "apiKey"}).key(req))
+	assert.Equal(t, "10.0.0.1", (&StickySessionConfig{By: "ip"}).key(req))
+	assert.Equal(t, "wallet-1", (&StickySessionConfig{By: "header", Header: "X-Wallet"}).key(req))
+
+	assert.Nil(t, (&StickySessionConfig{By: "ip"}).validate())
+	assert.NotNil(t, (&StickySessionConfig{By: "header"}).validate())
+	assert.NotNil(t, (&StickySessionConfig{By: "cookie"}).validate())
+}
+
+func TestStickySessions(t *testing.T) {
+	var calls1, calls2 int32
+
+	s1 := newDelayedTestServer("0x1", 0, &calls1)
+	defer s1.Close()
+
+	s2 := newDelayedTestServer("0x2", 10*time.Millisecond, &calls2)
+	defer s2.Close()
+
+	config := &Config{
+		Strategy:      "FALLBACK",
+		Upstreams:     []*UpstreamConfig{{Url: s1.URL}, {Url: s2.URL}},
+		StickySession: StickySessionConfig{By: "header", Header: "X-Wallet"},
+	}
+
+	rcfg, err := BuildRunningConfigFromConfig(context.Background(), config)
+	assert.Nil(t, err)
+
+	// the fallback strategy moves to the next upstream after every request, the client sticks to the first one
+	for i := 0; i < 3; i++ {
+		req, _ := newRequest([]byte(`{"params": [], "method": "eth_getTransactionCount", "id": 1, "jsonrpc": "2.0"}`))
+		req.clientKey = "wallet-1"
+
+		_, bts, err := dispatch(context.Background(), req)
+
+		assert.Nil(t, err)
+		assert.Contains(t, string(bts), "0x1")
+	}
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls1))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls2))
+	assert.Equal(t, rcfg.Upstreams[0], rcfg.sessions.get("wallet-1"))
+
+	// fall over when the upstream is not available
+	rcfg.Upstreams[0].state().setStatus(upstreamDisabled)
+
+	req, _ := newRequest([]byte(`{"params": [], "method": "eth_getTransactionCount", "id": 1, "jsonrpc": "2.0"}`))
+	req.clientKey = "wallet-1"
+	_, bts, err := dispatch(context.Background(), req)
+
+	assert.Nil(t, err)
+	assert.Contains(t, string(bts), "0x2")
+	assert.Equal(t, rcfg.Upstreams[1], rcfg.sessions.get("wallet-1"))
+
+	rcfg.sessions.removeExpired(time.Now().Add(time.Hour))
+	assert.Nil(t, rcfg.sessions.get("wallet-1"))
+}
+
+func TestStickySessionsSameHost(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := "0x1"
+
+		if r.URL.Path == "/node2" {
+			result = "0x2"
+		}
+
+		_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"` + result + `"}`))
+	}))
+	defer server.Close()
+
+	config := &Config{
+		Strategy:      "FALLBACK",
+		Upstreams:     []*UpstreamConfig{{Url: server.URL + "/node1"}, {Url: server.URL + "/node2"}},
+		StickySession: StickySessionConfig{By: "header", Header: "X-Wallet"},
+	}
+
+	rcfg, err := BuildRunningConfigFromConfig(context.Background(), config)
+	assert.Nil(t, err)
+
+	// both upstreams have the same name, the session sticks to the one which served the request
+	rcfg.Upstreams[0].state().setStatus(upstreamDisabled)
+
+	req, _ := newRequest([]byte(`{"params": [], "method": "eth_getTransactionCount", "id": 1, "jsonrpc": "2.0"}`))
+	req.clientKey = "wallet-1"
+	_, bts, err := dispatch(context.Background(), req)
+
+	assert.Nil(t, err)
+	assert.Contains(t, string(bts), "0x2")
+	assert.Equal(t, rcfg.Upstreams[1], rcfg.sessions.get("wallet-1"))
+
+	rcfg.Upstreams[0].state().setStatus(upstreamEnabled)
+
+	req, _ = newRequest([]byte(`{"params": [], "method": "eth_getTransactionCount", "id": 1, "jsonrpc": "2.0"}`))
+	req.clientKey = "wallet-1"
+	_, bts, _ = dispatch(context.Background(), req)
+
+	assert.Contains(t, string(bts), "0x2")
+}
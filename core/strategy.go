@@ -1,24 +1,30 @@
 package core
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"math"
+	"math/rand"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
-
-	"github.com/HydroProtocol/ethereum-jsonrpc-gateway/utils"
-	"github.com/sirupsen/logrus"
 )
 
+// the strategy should stop all its upstream calls once ctx is done
 type IStrategy interface {
-	handle(*Request) ([]byte, error)
+	handle(context.Context, *Request) ([]byte, error)
 }
 
 var _ IStrategy = &NaiveProxy{}
 var _ IStrategy = &RaceProxy{}
 var _ IStrategy = &FallbackProxy{}
+var _ IStrategy = &HedgeProxy{}
+var _ IStrategy = &FastestProxy{}
+var _ IStrategy = &QuorumProxy{}
 
 type NaiveProxy struct{}
 
@@ -26,9 +32,15 @@ func newNaiveProxy() *NaiveProxy {
 	return &NaiveProxy{}
 }
 
-func (p *NaiveProxy) handle(req *Request) ([]byte, error) {
-	upstream := currentRunningConfig.Upstreams[0]
-	bts, err := upstream.handle(req)
+func (p *NaiveProxy) handle(ctx context.Context, req *Request) ([]byte, error) {
+	upstream := currentRunningConfig().Upstreams[0]
+
+	if !upstream.state().isAvailable() {
+		return nil, NoValidUpstreamError
+	}
+
+	req.setUpstream(upstream)
+	bts, err := upstream.handle(ctx, req)
 
 	if err != nil {
 		return nil, err
@@ -37,126 +49,760 @@ func (p *NaiveProxy) handle(req *Request) ([]byte, error) {
 	return bts, err
 }
 
-type RaceProxy struct{}
+type RaceProxy struct {
+	upstreams []Upstream // nil for the upstreams of the running config
+}
+
+type raceResponse struct {
+	upstream Upstream
+	bts      []byte
+	class    responseClass
+}
 
 func newRaceProxy() *RaceProxy {
 	return &RaceProxy{}
 }
 
-func (p *RaceProxy) handle(req *Request) ([]byte, error) {
+// the first successful response or deterministic error wins the race,
+// a retryable node error is returned only if no upstream succeeds
+func (p *RaceProxy) handle(ctx context.Context, req *Request) ([]byte, error) {
 	startAt := time.Now()
 
 	defer func() {
-		logrus.Debugf("geth_gateway %f", float64(time.Since(startAt))/1000000)
+		strategyLog.Debugf("geth_gateway %f", float64(time.Since(startAt))/1000000)
 	}()
 
-	successfulResponse := make(chan []byte, len(currentRunningConfig.Upstreams))
-	failedResponse := make(chan []byte, len(currentRunningConfig.Upstreams))
-	errorResponseUpstreams := make(chan Upstream, len(currentRunningConfig.Upstreams))
+	upstreams := filterAvailableUpstreams(upstreamsOrRunning(p.upstreams))
+
+	if len(upstreams) == 0 {
+		return nil, NoValidUpstreamError
+	}
 
-	for _, upstream := range currentRunningConfig.Upstreams {
+	// the losing legs are cancelled once the race is over
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	responses := make(chan *raceResponse, len(upstreams))
+
+	for _, upstream := range upstreams {
 		go func(upstream Upstream) {
 			defer func() {
 				if err := recover(); err != nil {
-					req.logger.Debugf("%v Upstream %s failed, err: %v\n", time.Now().Sub(startAt), upstream, err)
-					errorResponseUpstreams <- upstream
+					req.logger.Debugf("%v Upstream %s failed, err: %v\n", time.Now().Sub(startAt), upstream.state().name, err)
+					responses <- &raceResponse{upstream, nil, responseTransportError}
 				}
 			}()
 
-			bts, err := upstream.handle(req)
-
-			if err != nil {
-				req.logger.Debugf("%vms Upstream: %v, Error: %v\n", time.Now().Sub(startAt), upstream, err)
-				failedResponse <- nil
-				return
-			}
-
-			resBody := strings.TrimSpace(string(bts))
+			bts, err := upstream.handle(raceCtx, req)
+			class := classifyResponse(bts, err)
 
-			diff := time.Now().Sub(startAt)
-			if utils.NoErrorFieldInJSON(resBody) {
-				req.logger.Debugf("%v Upstream: %v Success, Body: %v\n", diff, upstream, resBody)
-				successfulResponse <- bts
-			} else {
-				req.logger.Debugf("%v Upstream: %v Failed, Body: %v\n", diff, upstream, resBody)
-				failedResponse <- bts
-			}
+			req.logger.Debugf("%v Upstream: %v %s, Error: %v, Body: %s\n", time.Now().Sub(startAt), upstream.state().name, class, err, strings.TrimSpace(string(bts)))
+			responses <- &raceResponse{upstream, bts, class}
 		}(upstream)
 	}
 
-	errorCount := 0
+	var retryableResponse *raceResponse
 
-	for errorCount < len(currentRunningConfig.Upstreams) {
+	for i := 0; i < len(upstreams); i++ {
 		select {
-		case <-time.After(time.Second * 10):
+		case <-ctx.Done():
 			req.logger.Debugf("%v Final Timeout\n", time.Now().Sub(startAt))
-			return nil, TimeoutError
-		case res := <-successfulResponse:
-			req.logger.Debugf("%v Final Success\n", time.Now().Sub(startAt))
-			return res, nil
-		case res := <-failedResponse:
-			return res, nil
-		case <-errorResponseUpstreams:
-			errorCount++
+			return nil, contextError(ctx)
+		case res := <-responses:
+			switch res.class {
+			case responseSuccess:
+				req.logger.Debugf("%v Final Success\n", time.Now().Sub(startAt))
+				req.setUpstream(res.upstream)
+				raceWinsTotal.WithLabelValues(req.upstream).Inc()
+				return res.bts, nil
+			case responseDeterministicError:
+				req.setUpstream(res.upstream)
+				return res.bts, nil
+			case responseRetryableError:
+				retryableResponse = res
+			}
 		}
 	}
 
+	if retryableResponse != nil {
+		req.setUpstream(retryableResponse.upstream)
+		return retryableResponse.bts, nil
+	}
+
 	req.logger.Errorf("%v Final Failed\n", time.Now().Sub(startAt))
 
-	logrus.Errorf("geth_gateway_fail")
+	strategyLog.Errorf("geth_gateway_fail")
 
 	return nil, AllUpstreamsFailedError
 }
 
 type FallbackProxy struct {
 	currentUpstreamIndex *atomic.Value
-	upsteamStatus        *sync.Map
+	upstreams            []Upstream // nil for the upstreams of the running config
 }
 
 func newFallbackProxy() *FallbackProxy {
 	v := &atomic.Value{}
 	v.Store(0)
 
-	p := &FallbackProxy{
+	return &FallbackProxy{
 		currentUpstreamIndex: v,
-		upsteamStatus:        &sync.Map{},
 	}
+}
+
+// failed upstreams are skipped until their circuit breakers let requests through again,
+// the next upstream is also tried on node errors which another node may not have
+func (p *FallbackProxy) handle(ctx context.Context, req *Request) ([]byte, error) {
+	var retryableResponse []byte
+	var retryableUpstream Upstream
+
+	upstreams := upstreamsOrRunning(p.upstreams)
+
+	for i := 0; i < len(upstreams); i++ {
+		index := p.currentUpstreamIndex.Load().(int)
+		nextUpstreamIndex := int(math.Mod(float64(index+1), float64(len(upstreams))))
+
+		upstream := upstreams[index]
+
+		if !upstream.state().isAvailable() {
+			p.currentUpstreamIndex.Store(nextUpstreamIndex)
+			continue
+		}
+
+		req.setUpstream(upstream)
+		bts, err := upstream.handle(ctx, req)
+
+		// the request is abandoned, it's not the fault of the upstream
+		if ctx.Err() != nil {
+			return nil, contextError(ctx)
+		}
 
-	for i := 0; i < len(currentRunningConfig.Upstreams); i++ {
-		p.upsteamStatus.Store(i, true)
+		class := classifyResponse(bts, err)
+
+		if class.isFinal() {
+			return bts, nil
+		}
+
+		if class == responseRetryableError {
+			retryableResponse, retryableUpstream = bts, req.served
+		}
+
+		p.currentUpstreamIndex.Store(nextUpstreamIndex)
+		strategyLog.Infof("upstream %d return %s, err: %v, switch to %d", index, class, err, nextUpstreamIndex)
+	}
+
+	// a node error is better than nothing
+	if retryableResponse != nil {
+		req.setUpstream(retryableUpstream)
+		return retryableResponse, nil
 	}
 
-	return p
+	return nil, NoValidUpstreamError
 }
 
-func (p *FallbackProxy) handle(req *Request) ([]byte, error) {
-	for i := 0; i < len(currentRunningConfig.Upstreams); i++ {
-		index := p.currentUpstreamIndex.Load().(int)
+// HedgeConfig controls the HEDGE strategy, zero values use the defaults
+type HedgeConfig struct {
+	// wait this long for an answer before sending the request to another upstream
+	DelayMs int `json:"delayMs,omitempty"`
+	// if set, the delay is this percentile of the recent latencies, DelayMs is used until there are enough samples
+	Percentile float64 `json:"percentile,omitempty"`
+	// max upstreams a request is sent to, including the first one
+	MaxRequests int `json:"maxRequests,omitempty"`
+}
+
+const (
+	defaultHedgeDelay       = 200 * time.Millisecond
+	defaultHedgeMaxRequests = 2
+	hedgeLatencySamples     = 200
+	hedgeMinLatencySamples  = 20
+)
+
+// latencyHistory keeps the latencies of the recent requests
+type latencyHistory struct {
+	lock    sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func (h *latencyHistory) add(latency time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if len(h.samples) < hedgeLatencySamples {
+		h.samples = append(h.samples, latency)
+		return
+	}
+
+	h.samples[h.next] = latency
+	h.next = (h.next + 1) % hedgeLatencySamples
+}
+
+// percentile returns false if there are not enough samples
+func (h *latencyHistory) percentile(p float64) (time.Duration, bool) {
+	h.lock.Lock()
+	samples := append([]time.Duration(nil), h.samples...)
+	h.lock.Unlock()
+
+	if len(samples) < hedgeMinLatencySamples {
+		return 0, false
+	}
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+	index := int(math.Ceil(p/100*float64(len(samples)))) - 1
+
+	if index < 0 {
+		index = 0
+	} else if index >= len(samples) {
+		index = len(samples) - 1
+	}
+
+	return samples[index], true
+}
+
+// HedgeProxy sends the request to the best upstream first, and only sends it
+// to the next one if no answer arrives within the hedge delay, or the previous one failed.
+// The first answer wins.
+type HedgeProxy struct {
+	config    *HedgeConfig
+	latencies *latencyHistory
+}
+
+type hedgeResponse struct {
+	upstream Upstream
+	bts      []byte
+	err      error
+	latency  time.Duration
+}
+
+func newHedgeProxy(rcfg *RunningConfig) *HedgeProxy {
+	return &HedgeProxy{
+		config:    &rcfg.config.Hedge,
+		latencies: &latencyHistory{},
+	}
+}
+
+func (p *HedgeProxy) delay() time.Duration {
+	if p.config.Percentile > 0 {
+		if d, ok := p.latencies.percentile(p.config.Percentile); ok {
+			return d
+		}
+	}
+
+	return durationOrDefault(p.config.DelayMs, defaultHedgeDelay)
+}
+
+func (p *HedgeProxy) handle(ctx context.Context, req *Request) ([]byte, error) {
+	upstreams := rankedUpstreams()
+
+	if len(upstreams) == 0 {
+		return nil, NoValidUpstreamError
+	}
+
+	maxRequests := intOrDefault(p.config.MaxRequests, defaultHedgeMaxRequests)
+
+	if len(upstreams) > maxRequests {
+		upstreams = upstreams[:maxRequests]
+	}
+
+	// the slower legs are cancelled once an answer arrives
+	hedgeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	responses := make(chan *hedgeResponse, len(upstreams))
+
+	send := func(upstream Upstream) {
+		startAt := time.Now()
+		bts, err := upstream.handle(hedgeCtx, req)
+		responses <- &hedgeResponse{upstream, bts, err, time.Since(startAt)}
+	}
+
+	go send(upstreams[0])
+	sent, pending := 1, 1
+
+	timer := time.NewTimer(p.delay())
+	defer timer.Stop()
+
+	var retryableResponse *hedgeResponse
+
+	for pending > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, contextError(ctx)
+		case <-timer.C:
+			if sent < len(upstreams) {
+				req.logger.Debugf("no answer from %d upstreams in time, hedge to %s", sent, upstreams[sent].state().name)
+				hedgeRequestsTotal.WithLabelValues(upstreams[sent].state().name).Inc()
+
+				go send(upstreams[sent])
+				sent++
+				pending++
+
+				timer.Reset(p.delay())
+			}
+		case res := <-responses:
+			pending--
+
+			class := classifyResponse(res.bts, res.err)
+
+			if class.isFinal() {
+				p.latencies.add(res.latency)
+				req.setUpstream(res.upstream)
+				return res.bts, nil
+			}
+
+			req.logger.Debugf("hedge upstream %s %s: %v", res.upstream.state().name, class, res.err)
+
+			if class == responseRetryableError {
+				retryableResponse = res
+			}
+
+			// don't wait for the delay when the upstream has failed
+			if sent < len(upstreams) {
+				go send(upstreams[sent])
+				sent++
+				pending++
+			}
+		}
+	}
+
+	// a node error is better than nothing
+	if retryableResponse != nil {
+		req.setUpstream(retryableResponse.upstream)
+		return retryableResponse.bts, nil
+	}
+
+	strategyLog.Errorf("all hedged upstreams failed")
+
+	return nil, AllUpstreamsFailedError
+}
+
+// FastestConfig controls the FASTEST strategy, zero values use the defaults
+type FastestConfig struct {
+	// weight of the latest sample in the moving averages
+	Alpha float64 `json:"alpha,omitempty"`
+	// ratio of requests sent to a random upstream other than the best one
+	ExploreRatio float64 `json:"exploreRatio,omitempty"`
+	// latency added to the score of an upstream failing all requests
+	ErrorPenaltyMs int `json:"errorPenaltyMs,omitempty"`
+}
+
+const (
+	defaultFastestAlpha        = 0.2
+	defaultFastestExploreRatio = 0.05
+	defaultFastestErrorPenalty = time.Second
+)
+
+// upstreamScore keeps the exponentially weighted moving averages of an upstream
+type upstreamScore struct {
+	latency   float64 // seconds, of successful requests
+	errorRate float64
+	samples   int
+}
+
+// FastestProxy sends the request to the upstream with the lowest score, which
+// is the average latency plus a penalty of its error rate. Upstreams never used
+// have a zero score, and a few requests are sent to other upstreams so the
+// recovered ones can win back traffic. If the upstream fails, the next best one is used.
+type FastestProxy struct {
+	config    *FastestConfig
+	upstreams []Upstream // of the running config it's built in, the scores are by their indexes
+	lock      sync.Mutex
+	scores    []upstreamScore
+	random    func() float64
+}
+
+func newFastestProxy(rcfg *RunningConfig) *FastestProxy {
+	return &FastestProxy{
+		config:    &rcfg.config.Fastest,
+		upstreams: rcfg.Upstreams,
+		scores:    make([]upstreamScore, len(rcfg.Upstreams)),
+		random:    rand.Float64,
+	}
+}
+
+// the caller should hold the lock
+func (p *FastestProxy) score(index int) float64 {
+	s := p.scores[index]
+	return s.latency + s.errorRate*durationOrDefault(p.config.ErrorPenaltyMs, defaultFastestErrorPenalty).Seconds()
+}
+
+func (p *FastestProxy) observe(index int, latency time.Duration, failed bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	alpha := floatOrDefault(p.config.Alpha, defaultFastestAlpha)
+	s := &p.scores[index]
+
+	errorSample := 0.0
+
+	if failed {
+		errorSample = 1
+	}
+
+	if s.samples == 0 {
+		s.errorRate = errorSample
+	} else {
+		s.errorRate = alpha*errorSample + (1-alpha)*s.errorRate
+	}
+
+	if !failed {
+		if s.latency == 0 {
+			s.latency = latency.Seconds()
+		} else {
+			s.latency = alpha*latency.Seconds() + (1-alpha)*s.latency
+		}
+	}
+
+	s.samples++
+}
+
+// rankedIndexes returns indexes of the available upstreams, the best one first
+func (p *FastestProxy) rankedIndexes() []int {
+	indexes := make([]int, 0, len(p.upstreams))
+
+	for i, upstream := range p.upstreams {
+		if upstream.state().isAvailable() {
+			indexes = append(indexes, i)
+		}
+	}
+
+	p.lock.Lock()
+	sort.SliceStable(indexes, func(i, j int) bool { return p.score(indexes[i]) < p.score(indexes[j]) })
+	p.lock.Unlock()
 
-		value, _ := p.upsteamStatus.Load(index)
-		isUpstreamValid := value.(bool)
+	if len(indexes) > 1 && p.random() < floatOrDefault(p.config.ExploreRatio, defaultFastestExploreRatio) {
+		explored := 1 + int(p.random()*float64(len(indexes)-1))
 
-		if isUpstreamValid {
-			bts, err := currentRunningConfig.Upstreams[index].handle(req)
+		if explored >= len(indexes) {
+			explored = len(indexes) - 1
+		}
+
+		indexes[0], indexes[explored] = indexes[explored], indexes[0]
+	}
+
+	return indexes
+}
+
+func (p *FastestProxy) handle(ctx context.Context, req *Request) ([]byte, error) {
+	indexes := p.rankedIndexes()
+
+	if len(indexes) == 0 {
+		return nil, NoValidUpstreamError
+	}
+
+	var retryableResponse []byte
+	var retryableUpstream Upstream
+
+	for _, index := range indexes {
+		upstream := p.upstreams[index]
+
+		req.setUpstream(upstream)
+		startAt := time.Now()
+		bts, err := upstream.handle(ctx, req)
+
+		// the request is abandoned, it's not the fault of the upstream
+		if ctx.Err() != nil {
+			return nil, contextError(ctx)
+		}
+
+		class := classifyResponse(bts, err)
+		p.observe(index, time.Since(startAt), !class.isFinal())
+
+		if class.isFinal() {
+			return bts, nil
+		}
+
+		req.logger.Debugf("fastest upstream %s %s: %v", req.upstream, class, err)
+
+		if class == responseRetryableError {
+			retryableResponse, retryableUpstream = bts, req.served
+		}
+	}
+
+	// a node error is better than nothing
+	if retryableResponse != nil {
+		req.setUpstream(retryableUpstream)
+		return retryableResponse, nil
+	}
+
+	return nil, AllUpstreamsFailedError
+}
+
+// QuorumConfig controls the QUORUM strategy, zero values use the defaults
+type QuorumConfig struct {
+	// number of upstreams a request is sent to, default to all upstreams
+	Size int `json:"size,omitempty"`
+	// number of upstreams which must agree on the result, default to the majority of size
+	Required int `json:"required,omitempty"`
+	// only these methods need a quorum, other methods are sent to the best upstream. Empty means all methods
+	Methods []string `json:"methods,omitempty"`
+}
+
+// QuorumProxy sends the request to several upstreams and only returns a result
+// when enough of them agree on it. Results are compared after normalization,
+// deterministic rpc errors by their code and message. Node errors, such as a
+// missing trie node, are no answer and don't vote.
+type QuorumProxy struct {
+	size     int
+	required int
+	methods  map[string]bool
+}
+
+type quorumResponse struct {
+	upstream Upstream
+	bts      []byte
+	err      error
+}
+
+func newQuorumProxy(rcfg *RunningConfig) (*QuorumProxy, error) {
+	cfg := rcfg.config.Quorum
+	upstreamsCount := len(rcfg.Upstreams)
+
+	size := cfg.Size
+
+	if size <= 0 || size > upstreamsCount {
+		size = upstreamsCount
+	}
+
+	required := cfg.Required
+
+	if required <= 0 {
+		required = size/2 + 1
+	}
+
+	if required > size {
+		return nil, fmt.Errorf("quorum proxy strategy require %d upstreams to agree, but only %d are used", required, size)
+	}
+
+	methods := make(map[string]bool)
+
+	for _, method := range cfg.Methods {
+		methods[method] = true
+	}
+
+	return &QuorumProxy{
+		size:     size,
+		required: required,
+		methods:  methods,
+	}, nil
+}
+
+// quorumKey returns the normalized result, or error code and message of a response,
+// hex strings are compared case insensitively
+func quorumKey(bts []byte) (string, error) {
+	var res rpcResponseData
+
+	if err := json.Unmarshal(bts, &res); err != nil {
+		return "", err
+	}
+
+	if res.Error != nil {
+		return fmt.Sprintf("error:%d:%s", res.Error.Code, strings.ToLower(strings.TrimSpace(res.Error.Message))), nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(res.Result))
+	decoder.UseNumber()
+
+	var result interface{}
+
+	if len(res.Result) > 0 {
+		if err := decoder.Decode(&result); err != nil {
+			return "", err
+		}
+	}
+
+	normalized, _ := json.Marshal(normalizeQuorumValue(result))
+
+	return "result:" + string(normalized), nil
+}
+
+func normalizeQuorumValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		if strings.HasPrefix(v, "0x") || strings.HasPrefix(v, "0X") {
+			return strings.ToLower(v)
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = normalizeQuorumValue(v[i])
+		}
+		return v
+	case map[string]interface{}:
+		for key := range v {
+			v[key] = normalizeQuorumValue(v[key])
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func (p *QuorumProxy) handle(ctx context.Context, req *Request) ([]byte, error) {
+	upstreams := rankedUpstreams()
 
-			if err != nil {
-				nextUpstreamIndex := int(math.Mod(float64(index+1), float64(len(currentRunningConfig.Upstreams))))
-				p.currentUpstreamIndex.Store(nextUpstreamIndex)
-				p.upsteamStatus.Store(i, false)
+	if len(p.methods) > 0 && !p.methods[req.data.Method] {
+		return p.handleOne(ctx, req, upstreams)
+	}
+
+	if len(upstreams) < p.required {
+		return nil, NoValidUpstreamError
+	}
+
+	if len(upstreams) > p.size {
+		upstreams = upstreams[:p.size]
+	}
 
-				logrus.Infof("upstream %d return err, switch to %d", index, nextUpstreamIndex)
+	// the remaining calls are cancelled once the quorum is reached
+	quorumCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-				go func(i int) {
-					<-time.After(5 * time.Second)
-					p.upsteamStatus.Store(i, true)
-				}(index)
+	responses := make(chan *quorumResponse, len(upstreams))
+
+	for _, upstream := range upstreams {
+		go func(upstream Upstream) {
+			bts, err := upstream.handle(quorumCtx, req)
+			responses <- &quorumResponse{upstream, bts, err}
+		}(upstream)
+	}
+
+	votes := make(map[string]int)
+	answers := make(map[string]string, len(upstreams))
+
+	for pending := len(upstreams); pending > 0; pending-- {
+		var res *quorumResponse
+
+		select {
+		case <-ctx.Done():
+			return nil, contextError(ctx)
+		case res = <-responses:
+		}
+
+		name := res.upstream.state().name
+
+		if res.err != nil {
+			answers[name] = "error: " + res.err.Error()
+			continue
+		}
 
-				continue
-			} else {
-				return bts, nil
+		// another node may have the answer, a node error is no answer
+		if !classifyResponse(res.bts, nil).isFinal() {
+			answers[name] = "node error: " + string(res.bts)
+			continue
+		}
+
+		key, err := quorumKey(res.bts)
+
+		if err != nil {
+			answers[name] = "invalid response: " + string(res.bts)
+			continue
+		}
+
+		answers[name] = string(res.bts)
+		votes[key]++
+
+		if votes[key] >= p.required {
+			req.setUpstream(res.upstream)
+			return res.bts, nil
+		}
+
+		// stop early if no result can get enough votes
+		maxVotes := 0
+
+		for _, v := range votes {
+			if v > maxVotes {
+				maxVotes = v
 			}
 		}
+
+		if maxVotes+pending-1 < p.required {
+			break
+		}
+	}
+
+	quorumDivergencesTotal.WithLabelValues(metricMethodLabel(req.data.Method)).Inc()
+	req.logger.WithField("answers", answers).Warnf("upstreams diverge on %s, %d of %d need to agree", req.data.Method, p.required, len(upstreams))
+
+	return nil, QuorumNotReachedError
+}
+
+// handleOne sends the request to the best upstream, then the next one if it fails or answers a node error
+func (p *QuorumProxy) handleOne(ctx context.Context, req *Request, upstreams []Upstream) ([]byte, error) {
+	if len(upstreams) == 0 {
+		return nil, NoValidUpstreamError
+	}
+
+	var retryableResponse []byte
+	var retryableUpstream Upstream
+
+	for _, upstream := range upstreams {
+		req.setUpstream(upstream)
+		bts, err := upstream.handle(ctx, req)
+
+		if ctx.Err() != nil {
+			return nil, contextError(ctx)
+		}
+
+		class := classifyResponse(bts, err)
+
+		if class.isFinal() {
+			return bts, nil
+		}
+
+		if class == responseRetryableError {
+			retryableResponse, retryableUpstream = bts, req.served
+		}
+	}
+
+	// a node error is better than nothing
+	if retryableResponse != nil {
+		req.setUpstream(retryableUpstream)
+		return retryableResponse, nil
+	}
+
+	return nil, AllUpstreamsFailedError
+}
+
+// rankedUpstreams returns the available upstreams, the healthy and faster ones first
+func rankedUpstreams() []Upstream {
+	upstreams := availableUpstreams()
+
+	sort.SliceStable(upstreams, func(i, j int) bool {
+		si, sj := upstreams[i].state(), upstreams[j].state()
+
+		if hi, hj := si.isHealthy(), sj.isHealthy(); hi != hj {
+			return hi
+		}
+
+		return atomic.LoadInt64(&si.latency) < atomic.LoadInt64(&sj.latency)
+	})
+
+	return upstreams
+}
+
+// availableUpstreams returns the upstreams which can receive new requests
+func availableUpstreams() []Upstream {
+	return filterAvailableUpstreams(currentRunningConfig().Upstreams)
+}
+
+func filterAvailableUpstreams(all []Upstream) []Upstream {
+	upstreams := make([]Upstream, 0, len(all))
+
+	for _, upstream := range all {
+		if upstream.state().isAvailable() {
+			upstreams = append(upstreams, upstream)
+		}
+	}
+
+	return upstreams
+}
+
+// upstreamsOrRunning returns upstreams, or the upstreams of the running config if it's nil
+func upstreamsOrRunning(upstreams []Upstream) []Upstream {
+	if upstreams == nil {
+		return currentRunningConfig().Upstreams
 	}
 
-	return nil, fmt.Errorf("no valid upstream")
+	return upstreams
 }
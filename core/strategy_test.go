@@ -4,9 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
@@ -42,7 +48,7 @@ func TestNaiveProxyHandle(t *testing.T) {
 
 	err := json.Unmarshal([]byte(testConfigStr1), config)
 
-	currentRunningConfig, err = BuildRunningConfigFromConfig(ctx, config)
+	_, err = BuildRunningConfigFromConfig(ctx, config)
 
 	if err != nil {
 		logrus.Fatal(err)
@@ -57,7 +63,7 @@ func TestNaiveProxyHandle(t *testing.T) {
 
 	proxy := newNaiveProxy()
 
-	bts, err := proxy.handle(req1)
+	bts, err := proxy.handle(context.Background(), req1)
 
 	assert.Equal(t, nil, err)
 
@@ -95,7 +101,7 @@ func TestRaceProxyHandle(t *testing.T) {
 
 	err := json.Unmarshal([]byte(testConfigStr1), config)
 
-	currentRunningConfig, err = BuildRunningConfigFromConfig(ctx, config)
+	_, err = BuildRunningConfigFromConfig(ctx, config)
 
 	if err != nil {
 		logrus.Fatal(err)
@@ -110,7 +116,7 @@ func TestRaceProxyHandle(t *testing.T) {
 
 	proxy := newNaiveProxy()
 
-	bts, err := proxy.handle(req1)
+	bts, err := proxy.handle(context.Background(), req1)
 
 	assert.Equal(t, nil, err)
 
@@ -147,7 +153,7 @@ func TestFallbackProxyHandle(t *testing.T) {
 
 	err := json.Unmarshal([]byte(testConfigStr1), config)
 
-	currentRunningConfig, err = BuildRunningConfigFromConfig(ctx, config)
+	_, err = BuildRunningConfigFromConfig(ctx, config)
 
 	if err != nil {
 		logrus.Fatal(err)
@@ -162,9 +168,410 @@ func TestFallbackProxyHandle(t *testing.T) {
 
 	proxy := newFallbackProxy()
 
-	bts, err := proxy.handle(req1)
+	bts, err := proxy.handle(context.Background(), req1)
 
 	assert.Equal(t, nil, err)
 
 	assert.IsType(t, []byte{}, bts)
 }
+
+func TestRaceProxyCancelLosingUpstreams(t *testing.T) {
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer fast.Close()
+
+	cancelled := make(chan bool, 1)
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+
+		select {
+		case <-r.Context().Done():
+			cancelled <- true
+		case <-time.After(5 * time.Second):
+			cancelled <- false
+		}
+	}))
+	defer slow.Close()
+
+	buildTestConfig("RACE", fast.URL, slow.URL)
+
+	req, _ := newRequest([]byte(`{"params": [], "method": "eth_blockNumber", "id": 1, "jsonrpc": "2.0"}`))
+	bts, err := newRaceProxy().handle(context.Background(), req)
+
+	assert.Nil(t, err)
+	assert.Contains(t, string(bts), "0x1")
+	assert.Equal(t, fast.URL, req.upstream)
+	assert.True(t, <-cancelled)
+}
+
+func TestStrategyAbandonedRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	buildTestConfig("FALLBACK", server.URL, server.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	req, _ := newRequest([]byte(`{"params": [], "method": "eth_blockNumber", "id": 1, "jsonrpc": "2.0"}`))
+	_, _, err := dispatch(ctx, req)
+
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, outcomeCancelled, responseOutcome(nil, err))
+}
+
+func newDelayedTestServer(result string, delay time.Duration, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		atomic.AddInt32(calls, 1)
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(delay):
+		}
+
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"result":"%s"}`, result)))
+	}))
+}
+
+func TestHedgeProxyHandle(t *testing.T) {
+	var slowCalls, fastCalls int32
+
+	slow := newDelayedTestServer("0x1", time.Second, &slowCalls)
+	defer slow.Close()
+
+	fast := newDelayedTestServer("0x2", 0, &fastCalls)
+	defer fast.Close()
+
+	rcfg := buildTestConfig("HEDGE", slow.URL, fast.URL)
+	rcfg.config.Hedge.DelayMs = 20
+
+	// the first upstream is too slow, the request is hedged to the second one
+	req, _ := newRequest([]byte(`{"params": [], "method": "eth_blockNumber", "id": 1, "jsonrpc": "2.0"}`))
+	startAt := time.Now()
+	bts, err := newHedgeProxy(rcfg).handle(context.Background(), req)
+
+	assert.Nil(t, err)
+	assert.Contains(t, string(bts), "0x2")
+	assert.Equal(t, fast.URL, req.upstream)
+	assert.True(t, time.Since(startAt) < 500*time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&slowCalls))
+	assert.Equal(t, float64(1), testutil.ToFloat64(hedgeRequestsTotal.WithLabelValues(fast.URL)))
+
+	// no hedged request is needed when the first upstream answers in time
+	rcfg = buildTestConfig("HEDGE", fast.URL, slow.URL)
+	rcfg.config.Hedge.DelayMs = 200
+
+	req, _ = newRequest([]byte(`{"params": [], "method": "eth_blockNumber", "id": 1, "jsonrpc": "2.0"}`))
+	bts, err = newHedgeProxy(rcfg).handle(context.Background(), req)
+
+	assert.Nil(t, err)
+	assert.Contains(t, string(bts), "0x2")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&slowCalls))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fastCalls))
+}
+
+func TestHedgeProxyDelay(t *testing.T) {
+	rcfg := buildTestConfig("HEDGE", "http://test1.com", "http://test2.com")
+
+	p := newHedgeProxy(rcfg)
+	assert.Equal(t, defaultHedgeDelay, p.delay())
+
+	p.config.Percentile = 90
+
+	for i := 1; i <= hedgeMinLatencySamples-1; i++ {
+		p.latencies.add(time.Duration(i) * time.Millisecond)
+	}
+
+	// not enough samples
+	assert.Equal(t, defaultHedgeDelay, p.delay())
+
+	p.latencies.add(hedgeMinLatencySamples * time.Millisecond)
+	assert.Equal(t, 18*time.Millisecond, p.delay())
+}
+
+func TestFastestProxyHandle(t *testing.T) {
+	var slowCalls, fastCalls int32
+
+	slow := newDelayedTestServer("0x1", 50*time.Millisecond, &slowCalls)
+	defer slow.Close()
+
+	fast := newDelayedTestServer("0x2", 0, &fastCalls)
+	defer fast.Close()
+
+	rcfg := buildTestConfig("FASTEST", slow.URL, fast.URL)
+
+	p := newFastestProxy(rcfg)
+	p.random = func() float64 { return 1 }
+
+	// both upstreams are tried once, then the faster one gets the traffic
+	for i := 0; i < 5; i++ {
+		req, _ := newRequest([]byte(`{"params": [], "method": "eth_blockNumber", "id": 1, "jsonrpc": "2.0"}`))
+		_, err := p.handle(context.Background(), req)
+		assert.Nil(t, err)
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&slowCalls))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&fastCalls))
+
+	// exploration sends the request to another upstream
+	p.random = func() float64 { return 0 }
+
+	req, _ := newRequest([]byte(`{"params": [], "method": "eth_blockNumber", "id": 1, "jsonrpc": "2.0"}`))
+	bts, err := p.handle(context.Background(), req)
+
+	assert.Nil(t, err)
+	assert.Contains(t, string(bts), "0x1")
+	assert.Equal(t, slow.URL, req.upstream)
+}
+
+func TestFastestProxyScore(t *testing.T) {
+	rcfg := buildTestConfig("FASTEST", "http://test1.com", "http://test2.com")
+
+	p := newFastestProxy(rcfg)
+	p.random = func() float64 { return 1 }
+
+	p.observe(0, 100*time.Millisecond, false)
+	p.observe(1, 10*time.Millisecond, false)
+	assert.Equal(t, []int{1, 0}, p.rankedIndexes())
+
+	// the errors make the faster upstream worse
+	p.observe(1, time.Millisecond, true)
+	p.observe(1, time.Millisecond, true)
+	assert.Equal(t, []int{0, 1}, p.rankedIndexes())
+	assert.InDelta(t, 0.01, p.scores[1].latency, 0.0001)
+	assert.InDelta(t, 0.36, p.scores[1].errorRate, 0.0001)
+}
+
+func TestFastestProxyReload(t *testing.T) {
+	var calls int32
+
+	s1 := newDelayedTestServer("0x1", 0, &calls)
+	defer s1.Close()
+
+	s2 := newDelayedTestServer("0x2", 0, &calls)
+	defer s2.Close()
+
+	p := newFastestProxy(buildTestConfig("FASTEST", s1.URL, s2.URL))
+	p.random = func() float64 { return 1 }
+
+	// a request in flight on the replaced config keeps using its upstreams
+	buildTestConfig("FASTEST", "http://test1.com", "http://test2.com", "http://test3.com")
+
+	req, _ := newRequest([]byte(`{"params": [], "method": "eth_blockNumber", "id": 1, "jsonrpc": "2.0"}`))
+	bts, err := p.handle(context.Background(), req)
+
+	assert.Nil(t, err)
+	assert.Contains(t, string(bts), "0x1")
+	assert.Equal(t, 2, len(p.rankedIndexes()))
+}
+
+func TestQuorumKey(t *testing.T) {
+	k1, _ := quorumKey([]byte(`{"jsonrpc":"2.0","id":1,"result":{"to":"0xABcd","value":"0x1","nonce":1}}`))
+	k2, _ := quorumKey([]byte(`{"id":2,"jsonrpc":"2.0","result":{"nonce":1,"value":"0x1","to":"0xabcd"}}`))
+	assert.Equal(t, k1, k2)
+
+	k3, _ := quorumKey([]byte(`{"jsonrpc":"2.0","id":1,"result":"Hello"}`))
+	k4, _ := quorumKey([]byte(`{"jsonrpc":"2.0","id":1,"result":"hello"}`))
+	assert.NotEqual(t, k3, k4)
+
+	k5, _ := quorumKey([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"Execution reverted"}}`))
+	assert.Equal(t, "error:-32000:execution reverted", k5)
+
+	k6, _ := quorumKey([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"nonce too low"}}`))
+	assert.NotEqual(t, k5, k6)
+
+	_, err := quorumKey([]byte(`not json`))
+	assert.NotNil(t, err)
+}
+
+func TestQuorumProxyHandle(t *testing.T) {
+	var calls int32
+
+	s1 := newDelayedTestServer("0xAB", 0, &calls)
+	defer s1.Close()
+
+	s2 := newDelayedTestServer("0x01", 0, &calls)
+	defer s2.Close()
+
+	s3 := newDelayedTestServer("0xab", 20*time.Millisecond, &calls)
+	defer s3.Close()
+
+	rcfg := buildTestConfig("QUORUM", s1.URL, s2.URL, s3.URL)
+
+	p, _ := newQuorumProxy(rcfg)
+	assert.Equal(t, 3, p.size)
+	assert.Equal(t, 2, p.required)
+
+	req, _ := newRequest([]byte(`{"params": [], "method": "eth_blockNumber", "id": 1, "jsonrpc": "2.0"}`))
+	bts, err := p.handle(context.Background(), req)
+
+	assert.Nil(t, err)
+	assert.Contains(t, strings.ToLower(string(bts)), "0xab")
+
+	// all the upstreams are required to agree
+	p.required = 3
+
+	req, _ = newRequest([]byte(`{"params": [], "method": "eth_getBalance", "id": 1, "jsonrpc": "2.0"}`))
+	_, err = p.handle(context.Background(), req)
+
+	assert.Equal(t, QuorumNotReachedError, err)
+	assert.Equal(t, float64(1), testutil.ToFloat64(quorumDivergencesTotal.WithLabelValues("eth_getBalance")))
+
+	// methods not listed are sent to one upstream
+	p.methods = map[string]bool{"eth_getBalance": true}
+	before := atomic.LoadInt32(&calls)
+
+	req, _ = newRequest([]byte(`{"params": [], "method": "eth_blockNumber", "id": 1, "jsonrpc": "2.0"}`))
+	_, err = p.handle(context.Background(), req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, before+1, atomic.LoadInt32(&calls))
+}
+
+func TestQuorumProxyNodeErrors(t *testing.T) {
+	var calls int32
+
+	pruned := newBodyTestServer(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"missing trie node 1a2b (path )"}}`, &calls)
+	defer pruned.Close()
+
+	lagging := newBodyTestServer(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"header not found"}}`, &calls)
+	defer lagging.Close()
+
+	synced := newDelayedTestServer("0x5", 20*time.Millisecond, &calls)
+	defer synced.Close()
+
+	rcfg := buildTestConfig("QUORUM", pruned.URL, lagging.URL, synced.URL)
+
+	// node errors don't vote, even with the same code
+	p, _ := newQuorumProxy(rcfg)
+	req, _ := newRequest([]byte(`{"params": ["0x01", "0x1"], "method": "eth_getBalance", "id": 1, "jsonrpc": "2.0"}`))
+	_, err := p.handle(context.Background(), req)
+
+	assert.Equal(t, QuorumNotReachedError, err)
+
+	// a method without quorum falls through node errors to the next upstream
+	p.methods = map[string]bool{"eth_call": true}
+
+	atomic.StoreInt64(&rcfg.Upstreams[2].state().latency, int64(time.Second))
+
+	req, _ = newRequest([]byte(`{"params": ["0x01", "0x1"], "method": "eth_getBalance", "id": 1, "jsonrpc": "2.0"}`))
+	bts, err := p.handle(context.Background(), req)
+
+	assert.Nil(t, err)
+	assert.Contains(t, string(bts), `"0x5"`)
+	assert.Equal(t, synced.URL, req.upstream)
+}
+
+func TestNewQuorumProxyInvalidConfig(t *testing.T) {
+	rcfg := buildTestConfig("RACE", "http://test1.com", "http://test2.com")
+	rcfg.config.Quorum = QuorumConfig{Size: 2, Required: 3}
+
+	_, err := newQuorumProxy(rcfg)
+	assert.NotNil(t, err)
+	assert.NotNil(t, rcfg.switchStrategy("QUORUM"))
+}
+
+func newBodyTestServer(body string, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		atomic.AddInt32(calls, 1)
+		_, _ = w.Write([]byte(body))
+	}))
+}
+
+func TestRaceProxyNodeErrors(t *testing.T) {
+	var calls int32
+
+	lagging := newBodyTestServer(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"header not found"}}`, &calls)
+	defer lagging.Close()
+
+	synced := newDelayedTestServer("0x1", 20*time.Millisecond, &calls)
+	defer synced.Close()
+
+	buildTestConfig("RACE", lagging.URL, synced.URL)
+
+	// wait for a successful response instead of returning the node error
+	req, _ := newRequest([]byte(`{"params": ["0x1", false], "method": "eth_getBlockByNumber", "id": 1, "jsonrpc": "2.0"}`))
+	bts, err := newRaceProxy().handle(context.Background(), req)
+
+	assert.Nil(t, err)
+	assert.Contains(t, string(bts), `"result"`)
+	assert.Equal(t, synced.URL, req.upstream)
+
+	// deterministic errors are returned as-is
+	reverted := newBodyTestServer(`{"jsonrpc":"2.0","id":1,"error":{"code":3,"message":"execution reverted"}}`, &calls)
+	defer reverted.Close()
+
+	buildTestConfig("RACE", reverted.URL, synced.URL)
+
+	req, _ = newRequest([]byte(`{"params": [], "method": "eth_call", "id": 1, "jsonrpc": "2.0"}`))
+	bts, err = newRaceProxy().handle(context.Background(), req)
+
+	assert.Nil(t, err)
+	assert.Contains(t, string(bts), "execution reverted")
+	assert.Equal(t, reverted.URL, req.upstream)
+}
+
+func TestFallbackProxyNodeErrors(t *testing.T) {
+	var calls int32
+
+	badGateway := newBodyTestServer(`<html><body>502 Bad Gateway</body></html>`, &calls)
+	defer badGateway.Close()
+
+	lagging := newBodyTestServer(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"missing trie node"}}`, &calls)
+	defer lagging.Close()
+
+	synced := newDelayedTestServer("0x1", 0, &calls)
+	defer synced.Close()
+
+	buildTestConfig("FALLBACK", badGateway.URL, lagging.URL, synced.URL)
+
+	req, _ := newRequest([]byte(`{"params": [], "method": "eth_getBalance", "id": 1, "jsonrpc": "2.0"}`))
+	bts, err := newFallbackProxy().handle(context.Background(), req)
+
+	assert.Nil(t, err)
+	assert.Contains(t, string(bts), "0x1")
+	assert.Equal(t, synced.URL, req.upstream)
+
+	// the node error is returned when no upstream succeeds
+	buildTestConfig("FALLBACK", badGateway.URL, lagging.URL)
+
+	req, _ = newRequest([]byte(`{"params": [], "method": "eth_getBalance", "id": 1, "jsonrpc": "2.0"}`))
+	bts, err = newFallbackProxy().handle(context.Background(), req)
+
+	assert.Nil(t, err)
+	assert.Contains(t, string(bts), "missing trie node")
+	assert.Equal(t, lagging.URL, req.upstream)
+}
+
+func TestStrategiesBatchResponse(t *testing.T) {
+	var calls int32
+	batch := `[{"jsonrpc":"2.0","id":1,"result":"0x1"},{"jsonrpc":"2.0","id":2,"result":"0x2"}]`
+
+	server1 := newBodyTestServer(batch, &calls)
+	defer server1.Close()
+
+	server2 := newBodyTestServer(batch, &calls)
+	defer server2.Close()
+
+	for _, strategy := range []string{"RACE", "FALLBACK", "HEDGE", "FASTEST"} {
+		buildTestConfig(strategy, server1.URL, server2.URL)
+
+		req, _ := newRequest([]byte(`[{"params": [], "method": "eth_blockNumber", "id": 1, "jsonrpc": "2.0"}, {"params": [], "method": "eth_chainId", "id": 2, "jsonrpc": "2.0"}]`))
+		_, bts, err := dispatch(context.Background(), req)
+
+		assert.Nil(t, err, strategy)
+		assert.Equal(t, batch, string(bts), strategy)
+	}
+}
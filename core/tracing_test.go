@@ -0,0 +1,60 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestInitTracing(t *testing.T) {
+	shutdown, err := InitTracing(context.Background(), "stdout", "")
+	assert.Nil(t, err)
+	assert.Nil(t, shutdown(context.Background()))
+
+	_, err = InitTracing(context.Background(), "unknown", "")
+	assert.NotNil(t, err)
+}
+
+func TestHttpUpstreamTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var traceparent string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		_, _ = ioutil.ReadAll(r.Body)
+		_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer server.Close()
+
+	buildTestConfig("NAIVE", server.URL)
+
+	u, _ := url.Parse(server.URL)
+	upstream, _ := newHttpUpstream(u, &UpstreamConfig{})
+
+	ctx, span := startSpan(context.Background(), "test")
+	req, _ := newRequestWithContext(ctx, "test", []byte(`{"params": [], "method": "eth_blockNumber", "id": 1, "jsonrpc": "2.0"}`))
+
+	_, err := upstream.handle(ctx, req)
+	span.End()
+
+	assert.Nil(t, err)
+	assert.Contains(t, traceparent, span.SpanContext().TraceID().String())
+
+	spans := recorder.Ended()
+	assert.Equal(t, 3, len(spans))
+	assert.Equal(t, "jsonrpc.validate", spans[0].Name())
+	assert.Equal(t, "upstream.call", spans[1].Name())
+	assert.Equal(t, span.SpanContext().TraceID(), spans[1].SpanContext().TraceID())
+}
@@ -0,0 +1,145 @@
+package core
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// TransportConfig tunes the connections to an upstream, zero values keep the defaults
+type TransportConfig struct {
+	// HTTP/2 is tried on https connections unless it's false
+	HTTP2 *bool `json:"http2,omitempty"`
+	// connections to the upstream, 0 is unlimited
+	MaxConnsPerHost int `json:"maxConnsPerHost,omitempty"`
+	// idle connections kept for re-use, the default is 200
+	MaxIdleConnsPerHost int `json:"maxIdleConnsPerHost,omitempty"`
+	// an idle connection is closed after this long, the default is 90s
+	IdleConnTimeoutMs int `json:"idleConnTimeoutMs,omitempty"`
+	// interval of the tcp keep-alive probes, the default is 30s
+	KeepAliveMs int `json:"keepAliveMs,omitempty"`
+	// proxy of the connections, the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are used if it's empty
+	ProxyUrl string `json:"proxyUrl,omitempty"`
+
+	TLS *TLSConfig `json:"tls,omitempty"`
+}
+
+// TLSConfig of https and wss upstreams
+type TLSConfig struct {
+	// pem file of the CAs verifying the upstream, instead of the system CAs
+	CAFile string `json:"caFile,omitempty"`
+	// pem files of the client certificate, for upstreams requiring mutual TLS
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	// overrides the host name verified in the upstream certificate
+	ServerName string `json:"serverName,omitempty"`
+	// skip verifying the upstream certificate, only for lab nodes
+	InsecureSkipVerify bool `json:"insecureSkipVerify"`
+}
+
+const (
+	defaultIdleConnTimeout = 90 * time.Second
+	defaultKeepAlive       = 30 * time.Second
+)
+
+func (c *TLSConfig) build() (*tls.Config, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if c.CAFile != "" {
+		bts, err := ioutil.ReadFile(c.CAFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+
+		if !pool.AppendCertsFromPEM(bts) {
+			return nil, fmt.Errorf("no certificate in ca file %s", c.CAFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// proxy returns the proxy function of the http transport and websocket dialer
+func (c *TransportConfig) proxy() (func(*http.Request) (*url.URL, error), error) {
+	if c.ProxyUrl == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	u, err := url.Parse(c.ProxyUrl)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy url %s", c.ProxyUrl)
+	}
+
+	return http.ProxyURL(u), nil
+}
+
+func (c *UpstreamConfig) transport() *TransportConfig {
+	if c.Transport == nil {
+		return &TransportConfig{}
+	}
+
+	return c.Transport
+}
+
+// newHttpTransport builds the transport of an upstream, it fails if the tls files or proxy url are invalid
+func newHttpTransport(cfg *UpstreamConfig) (*http.Transport, error) {
+	transportConfig := cfg.transport()
+
+	proxy, err := transportConfig.proxy()
+
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := transportConfig.TLS.build()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   cfg.connectTimeout(),
+			KeepAlive: durationOrDefault(transportConfig.KeepAliveMs, defaultKeepAlive),
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: cfg.connectTimeout(),
+		ForceAttemptHTTP2:   transportConfig.HTTP2 == nil || *transportConfig.HTTP2,
+		MaxConnsPerHost:     transportConfig.MaxConnsPerHost,
+		MaxIdleConnsPerHost: intOrDefault(transportConfig.MaxIdleConnsPerHost, maxIdleConnections),
+		IdleConnTimeout:     durationOrDefault(transportConfig.IdleConnTimeoutMs, defaultIdleConnTimeout),
+	}, nil
+}
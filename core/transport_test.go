@@ -0,0 +1,168 @@
+package core
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewHttpTransport(t *testing.T) {
+	transport, err := newHttpTransport(&UpstreamConfig{})
+
+	assert.Nil(t, err)
+	assert.True(t, transport.ForceAttemptHTTP2)
+	assert.Equal(t, maxIdleConnections, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, 0, transport.MaxConnsPerHost)
+	assert.Equal(t, defaultIdleConnTimeout, transport.IdleConnTimeout)
+	assert.Nil(t, transport.TLSClientConfig)
+
+	http2 := false
+
+	transport, err = newHttpTransport(&UpstreamConfig{Transport: &TransportConfig{
+		HTTP2:               &http2,
+		MaxConnsPerHost:     10,
+		MaxIdleConnsPerHost: 5,
+		IdleConnTimeoutMs:   1000,
+		ProxyUrl:            "http://proxy.local:3128",
+		TLS:                 &TLSConfig{InsecureSkipVerify: true, ServerName: "node.local"},
+	}})
+
+	assert.Nil(t, err)
+	assert.False(t, transport.ForceAttemptHTTP2)
+	assert.Equal(t, 10, transport.MaxConnsPerHost)
+	assert.Equal(t, 5, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, time.Second, transport.IdleConnTimeout)
+	assert.True(t, transport.TLSClientConfig.InsecureSkipVerify)
+	assert.Equal(t, "node.local", transport.TLSClientConfig.ServerName)
+
+	req, _ := http.NewRequest("POST", "http://node.example.com", nil)
+	proxy, _ := transport.Proxy(req)
+	assert.Equal(t, "proxy.local:3128", proxy.Host)
+
+	_, err = newHttpTransport(&UpstreamConfig{Transport: &TransportConfig{ProxyUrl: "proxy.local"}})
+	assert.NotNil(t, err)
+
+	_, err = newHttpTransport(&UpstreamConfig{Transport: &TransportConfig{TLS: &TLSConfig{CAFile: "/not/exist.pem"}}})
+	assert.NotNil(t, err)
+
+	_, err = newHttpTransport(&UpstreamConfig{Transport: &TransportConfig{TLS: &TLSConfig{CertFile: "/not/exist.pem"}}})
+	assert.NotNil(t, err)
+}
+
+func TestHttpUpstreamTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "gateway-tls")
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	_ = ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+
+	buildTestConfig("NAIVE", server.URL)
+
+	u, _ := url.Parse(server.URL)
+
+	send := func(cfg *UpstreamConfig) error {
+		upstream, err := newHttpUpstream(u, cfg)
+
+		if err != nil {
+			return err
+		}
+
+		req, _ := newRequest([]byte(`{"params": [], "method": "eth_blockNumber", "id": 1, "jsonrpc": "2.0"}`))
+		_, err = upstream.handle(context.Background(), req)
+
+		return err
+	}
+
+	assert.NotNil(t, send(&UpstreamConfig{}))
+	assert.Nil(t, send(&UpstreamConfig{Transport: &TransportConfig{TLS: &TLSConfig{CAFile: caFile}}}))
+	assert.Nil(t, send(&UpstreamConfig{Transport: &TransportConfig{TLS: &TLSConfig{InsecureSkipVerify: true}}}))
+
+	_, err := newHttpUpstream(u, &UpstreamConfig{Transport: &TransportConfig{TLS: &TLSConfig{CAFile: filepath.Join(dir, "none.pem")}}})
+	assert.NotNil(t, err)
+}
+
+func TestHttpUpstreamHTTP2(t *testing.T) {
+	protos := make(chan int, 2)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protos <- r.ProtoMajor
+		_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	buildTestConfig("NAIVE", server.URL)
+
+	u, _ := url.Parse(server.URL)
+	http2 := false
+
+	for _, c := range []struct {
+		http2 *bool
+		proto int
+	}{{nil, 2}, {&http2, 1}} {
+		upstream, _ := newHttpUpstream(u, &UpstreamConfig{Transport: &TransportConfig{
+			HTTP2: c.http2,
+			TLS:   &TLSConfig{InsecureSkipVerify: true},
+		}})
+
+		req, _ := newRequest([]byte(`{"params": [], "method": "eth_blockNumber", "id": 1, "jsonrpc": "2.0"}`))
+		_, err := upstream.handle(context.Background(), req)
+
+		assert.Nil(t, err)
+		assert.Equal(t, c.proto, <-protos)
+	}
+}
+
+func TestHttpUpstreamHeaders(t *testing.T) {
+	var header http.Header
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer server.Close()
+
+	buildTestConfig("NAIVE", server.URL)
+
+	u, _ := url.Parse(server.URL)
+	upstream, _ := newHttpUpstream(u, &UpstreamConfig{Headers: map[string]string{
+		"x-api-key":    "secret",
+		"Content-Type": "text/plain",
+	}})
+
+	req, _ := newRequest([]byte(`{"params": [], "method": "eth_blockNumber", "id": 1, "jsonrpc": "2.0"}`))
+	_, err := upstream.handle(context.Background(), req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", header.Get("X-Api-Key"))
+	assert.Equal(t, "application/json", header.Get("Content-Type"))
+}
+
+func TestBuildConfigInvalidTransport(t *testing.T) {
+	cfg := &Config{
+		Upstreams: []*UpstreamConfig{{Url: "http://test1.com"}},
+		Strategy:  "NAIVE",
+		Archive: ArchiveConfig{Upstreams: []*UpstreamConfig{{
+			Url:       "http://archive.com",
+			Transport: &TransportConfig{TLS: &TLSConfig{CAFile: "/not/exist.pem"}},
+		}}},
+	}
+
+	_, err := BuildRunningConfigFromConfig(context.Background(), cfg)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,146 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// ReadYourWritesConfig routes lookups of recently sent transactions to the upstream which accepted them
+type ReadYourWritesConfig struct {
+	Enabled bool `json:"enabled"`
+	// how long a transaction hash is remembered
+	WindowMs int `json:"windowMs,omitempty"`
+	// send the lookup to other upstreams if the upstream which accepted the transaction returns null
+	RetryNull bool `json:"retryNull"`
+}
+
+const defaultReadYourWritesWindow = 10 * time.Minute
+
+// lookup methods whose first param is a transaction hash
+var txLookupMethods = map[string]bool{
+	"eth_getTransactionByHash":    true,
+	"eth_getTransactionReceipt":   true,
+	"eth_getRawTransactionByHash": true,
+}
+
+type requestHandler func(context.Context, *Request) ([]byte, error)
+
+// txRoutes remembers which upstream accepted a transaction,
+// the hashes expire like sticky sessions
+type txRoutes struct {
+	hashes    *stickySessions
+	retryNull bool
+}
+
+func newTxRoutes(ctx context.Context, cfg *ReadYourWritesConfig) *txRoutes {
+	return &txRoutes{
+		hashes:    newStickySessions(ctx, durationOrDefault(cfg.WindowMs, defaultReadYourWritesWindow)),
+		retryNull: cfg.RetryNull,
+	}
+}
+
+func txLookupHash(req *Request) string {
+	if !txLookupMethods[req.data.Method] || len(req.data.Params) == 0 {
+		return ""
+	}
+
+	hash, _ := req.data.Params[0].(string)
+
+	return strings.ToLower(hash)
+}
+
+func isNullResult(bts []byte) bool {
+	var res rpcResponseData
+
+	if json.Unmarshal(bts, &res) != nil {
+		return false
+	}
+
+	return res.Error == nil && bytes.Equal(res.Result, []byte("null"))
+}
+
+// handle routes the lookups of remembered transactions, other requests are proxied by next.
+// The hashes of transactions accepted by an upstream are remembered.
+func (r *txRoutes) handle(ctx context.Context, req *Request, next requestHandler) ([]byte, error) {
+	if hash := txLookupHash(req); hash != "" {
+		if upstream := r.hashes.get(hash); upstream != nil {
+			return r.handleLookup(ctx, req, upstream, next)
+		}
+	}
+
+	bts, err := next(ctx, req)
+
+	if req.data.Method == "eth_sendRawTransaction" && err == nil && classifyResponse(bts, nil) == responseSuccess {
+		r.record(req, bts)
+	}
+
+	return bts, err
+}
+
+func (r *txRoutes) record(req *Request, bts []byte) {
+	var res struct {
+		Result string `json:"result"`
+	}
+
+	if json.Unmarshal(bts, &res) != nil || res.Result == "" || req.served == nil {
+		return
+	}
+
+	r.hashes.set(strings.ToLower(res.Result), req.served)
+}
+
+// handleLookup asks the upstream which accepted the transaction first,
+// then the others if it returns null and retryNull is enabled
+func (r *txRoutes) handleLookup(ctx context.Context, req *Request, accepted Upstream, next requestHandler) ([]byte, error) {
+	candidates := make([]Upstream, 0, len(currentRunningConfig().Upstreams))
+
+	if accepted.state().isAvailable() {
+		candidates = append(candidates, accepted)
+	}
+
+	if r.retryNull {
+		for _, upstream := range availableUpstreams() {
+			if upstream != accepted {
+				candidates = append(candidates, upstream)
+			}
+		}
+	}
+
+	var nullResponse []byte
+	var nullUpstream Upstream
+
+	for _, upstream := range candidates {
+		req.setUpstream(upstream)
+		bts, err := upstream.handle(ctx, req)
+
+		if ctx.Err() != nil {
+			return nil, contextError(ctx)
+		}
+
+		class := classifyResponse(bts, err)
+
+		if class == responseSuccess && isNullResult(bts) {
+			req.logger.Debugf("upstream %s returns null for %s", req.upstream, req.data.Method)
+
+			if nullResponse == nil {
+				nullResponse, nullUpstream = bts, req.served
+			}
+
+			continue
+		}
+
+		if class.isFinal() {
+			return bts, nil
+		}
+	}
+
+	if nullResponse != nil {
+		req.setUpstream(nullUpstream)
+		return nullResponse, nil
+	}
+
+	return next(ctx, req)
+}
@@ -0,0 +1,177 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newMethodTestServer answers every method with the given result, null for other methods
+func newMethodTestServer(results map[string]string, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data RequestData
+		bts, _ := ioutil.ReadAll(r.Body)
+		_ = json.Unmarshal(bts, &data)
+		atomic.AddInt32(calls, 1)
+
+		result, exist := results[data.Method]
+
+		if !exist {
+			result = "null"
+		}
+
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"result":%s}`, result)))
+	}))
+}
+
+func TestTxRoutes(t *testing.T) {
+	var calls1, calls2 int32
+
+	accepting := newMethodTestServer(map[string]string{
+		"eth_sendRawTransaction":    `"0xABCD"`,
+		"eth_getTransactionReceipt": `{"transactionHash":"0xabcd","status":"0x1"}`,
+	}, &calls1)
+	defer accepting.Close()
+
+	lagging := newMethodTestServer(map[string]string{}, &calls2)
+	defer lagging.Close()
+
+	config := &Config{
+		Strategy:       "FALLBACK",
+		Upstreams:      []*UpstreamConfig{{Url: accepting.URL}, {Url: lagging.URL}},
+		ReadYourWrites: ReadYourWritesConfig{Enabled: true, RetryNull: true},
+	}
+
+	rcfg, err := BuildRunningConfigFromConfig(context.Background(), config)
+	assert.Nil(t, err)
+
+	req, _ := newRequest([]byte(`{"params": ["0x00"], "method": "eth_sendRawTransaction", "id": 1, "jsonrpc": "2.0"}`))
+	_, _, err = dispatch(context.Background(), req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, rcfg.Upstreams[0], rcfg.txRoutes.hashes.get("0xabcd"))
+
+	// the fallback strategy has moved to the lagging upstream, but the lookup goes to the accepting one
+	rcfg.strategy.(*FallbackProxy).currentUpstreamIndex.Store(1)
+
+	for i := 0; i < 2; i++ {
+		req, _ = newRequest([]byte(`{"params": ["0xabcd"], "method": "eth_getTransactionReceipt", "id": 1, "jsonrpc": "2.0"}`))
+		_, bts, err := dispatch(context.Background(), req)
+
+		assert.Nil(t, err)
+		assert.Contains(t, string(bts), "transactionHash")
+		assert.Equal(t, accepting.URL, req.upstream)
+	}
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls2))
+
+	// unknown hashes are proxied by the strategy
+	req, _ = newRequest([]byte(`{"params": ["0x1234"], "method": "eth_getTransactionReceipt", "id": 1, "jsonrpc": "2.0"}`))
+	_, _, err = dispatch(context.Background(), req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls2))
+}
+
+func TestTxRoutesRetryNull(t *testing.T) {
+	var calls1, calls2 int32
+
+	accepting := newMethodTestServer(map[string]string{}, &calls1)
+	defer accepting.Close()
+
+	other := newMethodTestServer(map[string]string{
+		"eth_getTransactionByHash": `{"hash":"0xabcd"}`,
+	}, &calls2)
+	defer other.Close()
+
+	buildTestConfig("FALLBACK", accepting.URL, other.URL)
+
+	routes := newTxRoutes(context.Background(), &ReadYourWritesConfig{Enabled: true, RetryNull: true})
+	routes.hashes.set("0xabcd", currentRunningConfig().Upstreams[0])
+
+	next := func(ctx context.Context, req *Request) ([]byte, error) {
+		return nil, fmt.Errorf("should not be called")
+	}
+
+	req, _ := newRequest([]byte(`{"params": ["0xABCD"], "method": "eth_getTransactionByHash", "id": 1, "jsonrpc": "2.0"}`))
+	bts, err := routes.handle(context.Background(), req, next)
+
+	assert.Nil(t, err)
+	assert.Contains(t, string(bts), `"hash"`)
+	assert.Equal(t, other.URL, req.upstream)
+
+	// without retry, the null result of the accepting upstream is returned
+	routes.retryNull = false
+
+	req, _ = newRequest([]byte(`{"params": ["0xabcd"], "method": "eth_getTransactionByHash", "id": 1, "jsonrpc": "2.0"}`))
+	bts, err = routes.handle(context.Background(), req, next)
+
+	assert.Nil(t, err)
+	assert.True(t, isNullResult(bts))
+	assert.Equal(t, accepting.URL, req.upstream)
+}
+
+func TestTxRoutesSameHost(t *testing.T) {
+	var calls1, calls2 int32
+
+	node1 := newMethodTestServer(map[string]string{}, &calls1)
+	defer node1.Close()
+
+	node2 := newMethodTestServer(map[string]string{
+		"eth_sendRawTransaction":    `"0xabcd"`,
+		"eth_getTransactionReceipt": `{"transactionHash":"0xabcd","status":"0x1"}`,
+	}, &calls2)
+	defer node2.Close()
+
+	// both upstreams are behind one reverse proxy, so they have the same name
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := node1
+
+		if r.URL.Path == "/node2" {
+			target = node2
+		}
+
+		res, err := http.Post(target.URL, "application/json", r.Body)
+
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		defer res.Body.Close()
+		bts, _ := ioutil.ReadAll(res.Body)
+		_, _ = w.Write(bts)
+	}))
+	defer proxy.Close()
+
+	config := &Config{
+		Strategy:       "FALLBACK",
+		Upstreams:      []*UpstreamConfig{{Url: proxy.URL + "/node1"}, {Url: proxy.URL + "/node2"}},
+		ReadYourWrites: ReadYourWritesConfig{Enabled: true},
+	}
+
+	rcfg, err := BuildRunningConfigFromConfig(context.Background(), config)
+	assert.Nil(t, err)
+
+	rcfg.strategy.(*FallbackProxy).currentUpstreamIndex.Store(1)
+
+	req, _ := newRequest([]byte(`{"params": ["0x00"], "method": "eth_sendRawTransaction", "id": 1, "jsonrpc": "2.0"}`))
+	_, _, err = dispatch(context.Background(), req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, rcfg.Upstreams[1], rcfg.txRoutes.hashes.get("0xabcd"))
+
+	req, _ = newRequest([]byte(`{"params": ["0xabcd"], "method": "eth_getTransactionReceipt", "id": 1, "jsonrpc": "2.0"}`))
+	_, bts, err := dispatch(context.Background(), req)
+
+	assert.Nil(t, err)
+	assert.Contains(t, string(bts), "transactionHash")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls1))
+}
@@ -0,0 +1,359 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TxTrackerConfig controls tracking and rebroadcasting of relayed transactions
+type TxTrackerConfig struct {
+	Enabled bool `json:"enabled"`
+	// how often pending transactions are checked
+	CheckIntervalMs int `json:"checkIntervalMs,omitempty"`
+	// a pending transaction is sent to upstreams again after this long
+	RebroadcastIntervalMs int `json:"rebroadcastIntervalMs,omitempty"`
+	// a transaction pending for this long is dropped, and a finished one is forgotten
+	MaxAgeMs int `json:"maxAgeMs,omitempty"`
+	// new transactions are not tracked when there are this many
+	MaxTracked int `json:"maxTracked,omitempty"`
+}
+
+const (
+	defaultTxCheckInterval       = 15 * time.Second
+	defaultTxRebroadcastInterval = time.Minute
+	defaultTxMaxAge              = time.Hour
+	defaultTxMaxTracked          = 10000
+)
+
+// status of a tracked transaction
+const (
+	txPending  = "pending"
+	txMined    = "mined"
+	txReplaced = "replaced"
+	txDropped  = "dropped"
+)
+
+type trackedTx struct {
+	Hash            string    `json:"hash"`
+	Status          string    `json:"status"`
+	From            string    `json:"from,omitempty"`
+	Nonce           string    `json:"nonce,omitempty"`
+	BlockNumber     string    `json:"blockNumber,omitempty"`
+	Rebroadcasts    int       `json:"rebroadcasts"`
+	SubmittedAt     time.Time `json:"submittedAt"`
+	LastBroadcastAt time.Time `json:"lastBroadcastAt"`
+	UpdatedAt       time.Time `json:"updatedAt"`
+
+	raw string
+}
+
+// txTracker records raw transactions relayed by the gateway, checks whether they are
+// mined and rebroadcasts the pending ones until they are mined, replaced or dropped
+type txTracker struct {
+	lock     sync.Mutex
+	config   *TxTrackerConfig
+	txs      map[string]*trackedTx
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+func newTxTracker(cfg *TxTrackerConfig) *txTracker {
+	return &txTracker{
+		config:  cfg,
+		txs:     make(map[string]*trackedTx),
+		stopped: make(chan struct{}),
+	}
+}
+
+// run checks the transactions until ctx is done or the tracker is stopped
+func (t *txTracker) run(ctx context.Context) {
+	ticker := time.NewTicker(durationOrDefault(t.config.CheckIntervalMs, defaultTxCheckInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.stopped:
+			return
+		case <-ticker.C:
+			t.check(ctx)
+		}
+	}
+}
+
+func (t *txTracker) stop() {
+	t.stopOnce.Do(func() { close(t.stopped) })
+}
+
+// takeOver stops the tracker of the replaced config and tracks its transactions
+func (t *txTracker) takeOver(previous *txTracker) {
+	previous.stop()
+
+	txs := previous.list("")
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for i := range txs {
+		if _, exist := t.txs[txs[i].Hash]; !exist {
+			t.txs[txs[i].Hash] = &txs[i]
+		}
+	}
+}
+
+// track records the transaction of a successful eth_sendRawTransaction request
+func (t *txTracker) track(req *Request, bts []byte) {
+	var res struct {
+		Result string `json:"result"`
+	}
+
+	if json.Unmarshal(bts, &res) != nil || res.Result == "" || len(req.data.Params) == 0 {
+		return
+	}
+
+	raw, _ := req.data.Params[0].(string)
+	hash := strings.ToLower(res.Result)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if _, exist := t.txs[hash]; exist {
+		return
+	}
+
+	if len(t.txs) >= intOrDefault(t.config.MaxTracked, defaultTxMaxTracked) {
+		txTrackerLog.Warnf("too many tracked transactions, %s is not tracked", hash)
+		return
+	}
+
+	now := time.Now()
+
+	t.txs[hash] = &trackedTx{
+		Hash:            hash,
+		Status:          txPending,
+		SubmittedAt:     now,
+		LastBroadcastAt: now,
+		UpdatedAt:       now,
+		raw:             raw,
+	}
+}
+
+func (t *txTracker) get(hash string) (trackedTx, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	tx, exist := t.txs[strings.ToLower(hash)]
+
+	if !exist {
+		return trackedTx{}, false
+	}
+
+	return *tx, true
+}
+
+// list returns the tracked transactions with the status, or all of them if status is empty
+func (t *txTracker) list(status string) []trackedTx {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	txs := make([]trackedTx, 0, len(t.txs))
+
+	for _, tx := range t.txs {
+		if status == "" || tx.Status == status {
+			txs = append(txs, *tx)
+		}
+	}
+
+	sort.Slice(txs, func(i, j int) bool { return txs[i].SubmittedAt.Before(txs[j].SubmittedAt) })
+
+	return txs
+}
+
+func (t *txTracker) update(hash string, f func(tx *trackedTx)) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if tx, exist := t.txs[hash]; exist {
+		f(tx)
+		tx.UpdatedAt = time.Now()
+	}
+}
+
+// call sends a request of the gateway itself with the running strategy
+func (t *txTracker) call(ctx context.Context, method string, params ...interface{}) (json.RawMessage, error) {
+	_, bts, err := dispatch(ctx, newInternalRequest(method, params...))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var res rpcResponseData
+
+	if err := json.Unmarshal(bts, &res); err != nil {
+		return nil, err
+	}
+
+	if res.Error != nil {
+		return nil, fmt.Errorf("%s returns error: %s", method, res.Error.Message)
+	}
+
+	return res.Result, nil
+}
+
+func isNull(result json.RawMessage) bool {
+	return len(result) == 0 || string(result) == "null"
+}
+
+// check updates the status of the pending transactions, and forgets the finished ones
+func (t *txTracker) check(ctx context.Context) {
+	maxAge := durationOrDefault(t.config.MaxAgeMs, defaultTxMaxAge)
+	now := time.Now()
+
+	for _, tx := range t.list(txPending) {
+		status := t.checkPending(ctx, tx)
+
+		if status == txPending && now.Sub(tx.SubmittedAt) >= maxAge {
+			status = txDropped
+		}
+
+		if status != txPending {
+			txTrackerLog.Infof("tracked transaction %s %s", tx.Hash, status)
+			t.update(tx.Hash, func(tx *trackedTx) { tx.Status = status })
+			continue
+		}
+
+		if now.Sub(tx.LastBroadcastAt) >= durationOrDefault(t.config.RebroadcastIntervalMs, defaultTxRebroadcastInterval) {
+			t.rebroadcast(ctx, tx)
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	counts := map[string]int{txPending: 0, txMined: 0, txReplaced: 0, txDropped: 0}
+
+	for hash, tx := range t.txs {
+		if tx.Status != txPending && now.Sub(tx.UpdatedAt) >= maxAge {
+			delete(t.txs, hash)
+			continue
+		}
+
+		counts[tx.Status]++
+	}
+
+	for status, count := range counts {
+		trackedTransactions.WithLabelValues(status).Set(float64(count))
+	}
+}
+
+// checkPending returns the new status of a pending transaction
+func (t *txTracker) checkPending(ctx context.Context, tx trackedTx) string {
+	mined, err := t.checkReceipt(ctx, tx.Hash)
+
+	if err != nil {
+		return txPending
+	}
+
+	if mined {
+		return txMined
+	}
+
+	// the sender and nonce are known once an upstream has seen the transaction
+	if tx.From == "" {
+		result, err := t.call(ctx, "eth_getTransactionByHash", tx.Hash)
+
+		if err != nil || isNull(result) {
+			return txPending
+		}
+
+		var r struct {
+			From  string `json:"from"`
+			Nonce string `json:"nonce"`
+		}
+
+		_ = json.Unmarshal(result, &r)
+		tx.From, tx.Nonce = r.From, r.Nonce
+		t.update(tx.Hash, func(tx *trackedTx) { tx.From, tx.Nonce = r.From, r.Nonce })
+	}
+
+	if tx.From == "" || tx.Nonce == "" {
+		return txPending
+	}
+
+	// the nonce is used by another transaction
+	result, err := t.call(ctx, "eth_getTransactionCount", tx.From, "latest")
+
+	if err != nil {
+		return txPending
+	}
+
+	var count string
+	_ = json.Unmarshal(result, &count)
+
+	minedNonce, err1 := strconv.ParseUint(count, 0, 64)
+	nonce, err2 := strconv.ParseUint(tx.Nonce, 0, 64)
+
+	if err1 == nil && err2 == nil && minedNonce > nonce {
+		// the transaction itself may be mined since its receipt was asked
+		mined, err = t.checkReceipt(ctx, tx.Hash)
+
+		if err != nil {
+			return txPending
+		}
+
+		if mined {
+			return txMined
+		}
+
+		return txReplaced
+	}
+
+	return txPending
+}
+
+// checkReceipt tells whether the transaction is mined, and records its block
+func (t *txTracker) checkReceipt(ctx context.Context, hash string) (bool, error) {
+	receipt, err := t.call(ctx, "eth_getTransactionReceipt", hash)
+
+	if err != nil {
+		txTrackerLog.Debugf("get receipt of tracked transaction %s failed: %v", hash, err)
+		return false, err
+	}
+
+	if isNull(receipt) {
+		return false, nil
+	}
+
+	var r struct {
+		BlockNumber string `json:"blockNumber"`
+	}
+
+	_ = json.Unmarshal(receipt, &r)
+	t.update(hash, func(tx *trackedTx) { tx.BlockNumber = r.BlockNumber })
+
+	return true, nil
+}
+
+func (t *txTracker) rebroadcast(ctx context.Context, tx trackedTx) {
+	rcfg := currentRunningConfig()
+
+	ctx, cancel := context.WithTimeout(ctx, rcfg.requestTimeout)
+	defer cancel()
+
+	_, err := rcfg.broadcaster.handle(ctx, newInternalRequest("eth_sendRawTransaction", tx.raw))
+
+	txTrackerLog.Infof("rebroadcast tracked transaction %s, err: %v", tx.Hash, err)
+	txRebroadcastsTotal.Inc()
+
+	t.update(tx.Hash, func(tx *trackedTx) {
+		tx.Rebroadcasts++
+		tx.LastBroadcastAt = time.Now()
+	})
+}
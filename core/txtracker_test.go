@@ -0,0 +1,194 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func buildTxTrackerTestConfig(t *testing.T, results map[string]string, calls *int32) *RunningConfig {
+	server := newMethodTestServer(results, calls)
+	t.Cleanup(server.Close)
+
+	config := &Config{
+		Strategy:  "NAIVE",
+		Upstreams: []*UpstreamConfig{{Url: server.URL}},
+		TxTracker: TxTrackerConfig{Enabled: true},
+	}
+
+	rcfg, err := BuildRunningConfigFromConfig(context.Background(), config)
+	assert.Nil(t, err)
+
+	// the transaction is tracked once it's relayed
+	req, _ := newRequest([]byte(`{"params": ["0x00"], "method": "eth_sendRawTransaction", "id": 1, "jsonrpc": "2.0"}`))
+	_, _, err = dispatch(context.Background(), req)
+	assert.Nil(t, err)
+
+	return rcfg
+}
+
+func TestTxTrackerRebroadcastAndDrop(t *testing.T) {
+	var calls int32
+
+	rcfg := buildTxTrackerTestConfig(t, map[string]string{
+		"eth_sendRawTransaction":   `"0xABCD"`,
+		"eth_getTransactionByHash": `{"hash":"0xabcd","from":"0x01","nonce":"0x5"}`,
+		"eth_getTransactionCount":  `"0x5"`,
+	}, &calls)
+
+	tracker := rcfg.txTracker
+	tx, exist := tracker.get("0xabcd")
+
+	assert.True(t, exist)
+	assert.Equal(t, txPending, tx.Status)
+	assert.Equal(t, "0x00", tx.raw)
+
+	tracker.config.RebroadcastIntervalMs = 1
+	time.Sleep(2 * time.Millisecond)
+	tracker.check(context.Background())
+
+	tx, _ = tracker.get("0xabcd")
+	assert.Equal(t, txPending, tx.Status)
+	assert.Equal(t, "0x01", tx.From)
+	assert.Equal(t, "0x5", tx.Nonce)
+	assert.Equal(t, 1, tx.Rebroadcasts)
+
+	// a transaction pending for too long is dropped, then forgotten
+	tracker.config.MaxAgeMs = 1
+	tracker.check(context.Background())
+
+	tx, _ = tracker.get("0xabcd")
+	assert.Equal(t, txDropped, tx.Status)
+	assert.Equal(t, 1, len(tracker.list(txDropped)))
+
+	time.Sleep(2 * time.Millisecond)
+	tracker.check(context.Background())
+
+	_, exist = tracker.get("0xabcd")
+	assert.False(t, exist)
+}
+
+func TestTxTrackerMined(t *testing.T) {
+	var calls int32
+
+	rcfg := buildTxTrackerTestConfig(t, map[string]string{
+		"eth_sendRawTransaction":    `"0xabcd"`,
+		"eth_getTransactionReceipt": `{"transactionHash":"0xabcd","blockNumber":"0x10"}`,
+	}, &calls)
+
+	rcfg.txTracker.check(context.Background())
+
+	tx, _ := rcfg.txTracker.get("0xabcd")
+	assert.Equal(t, txMined, tx.Status)
+	assert.Equal(t, "0x10", tx.BlockNumber)
+	assert.Equal(t, 0, tx.Rebroadcasts)
+
+	// a finished transaction is not checked again
+	before := atomic.LoadInt32(&calls)
+	rcfg.txTracker.check(context.Background())
+	assert.Equal(t, before, atomic.LoadInt32(&calls))
+}
+
+func TestTxTrackerReplaced(t *testing.T) {
+	var calls int32
+
+	rcfg := buildTxTrackerTestConfig(t, map[string]string{
+		"eth_sendRawTransaction":   `"0xabcd"`,
+		"eth_getTransactionByHash": `{"hash":"0xabcd","from":"0x01","nonce":"0x5"}`,
+		"eth_getTransactionCount":  `"0x6"`,
+	}, &calls)
+
+	rcfg.txTracker.check(context.Background())
+
+	tx, _ := rcfg.txTracker.get("0xabcd")
+	assert.Equal(t, txReplaced, tx.Status)
+}
+
+func TestTxTrackerMinedWhileChecked(t *testing.T) {
+	var receipts int32
+
+	// the transaction is mined after its first receipt request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data RequestData
+		bts, _ := ioutil.ReadAll(r.Body)
+		_ = json.Unmarshal(bts, &data)
+
+		results := map[string]string{
+			"eth_sendRawTransaction":    `"0xabcd"`,
+			"eth_getTransactionByHash":  `{"hash":"0xabcd","from":"0x01","nonce":"0x5"}`,
+			"eth_getTransactionCount":   `"0x6"`,
+			"eth_getTransactionReceipt": `null`,
+		}
+
+		if data.Method == "eth_getTransactionReceipt" && atomic.AddInt32(&receipts, 1) > 1 {
+			results[data.Method] = `{"transactionHash":"0xabcd","blockNumber":"0x10"}`
+		}
+
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"result":%s}`, results[data.Method])))
+	}))
+	defer server.Close()
+
+	rcfg, err := BuildRunningConfigFromConfig(context.Background(), &Config{
+		Strategy:  "NAIVE",
+		Upstreams: []*UpstreamConfig{{Url: server.URL}},
+		TxTracker: TxTrackerConfig{Enabled: true},
+	})
+	assert.Nil(t, err)
+
+	req, _ := newRequest([]byte(`{"params": ["0x00"], "method": "eth_sendRawTransaction", "id": 1, "jsonrpc": "2.0"}`))
+	_, _, err = dispatch(context.Background(), req)
+	assert.Nil(t, err)
+
+	rcfg.txTracker.check(context.Background())
+
+	tx, _ := rcfg.txTracker.get("0xabcd")
+	assert.Equal(t, txMined, tx.Status)
+	assert.Equal(t, "0x10", tx.BlockNumber)
+}
+
+func TestTxTrackerReload(t *testing.T) {
+	var calls int32
+
+	previous := buildTxTrackerTestConfig(t, map[string]string{"eth_sendRawTransaction": `"0xabcd"`}, &calls)
+
+	err := reloadRunningConfig(context.Background(), &Config{
+		Strategy:  "NAIVE",
+		Upstreams: []*UpstreamConfig{{Url: "http://test1.com"}},
+		TxTracker: TxTrackerConfig{Enabled: true},
+	})
+	assert.Nil(t, err)
+
+	// the tracked transactions move to the new tracker, and the previous one stops
+	tx, exist := currentRunningConfig().txTracker.get("0xabcd")
+	assert.True(t, exist)
+	assert.Equal(t, txPending, tx.Status)
+	assert.Equal(t, "0x00", tx.raw)
+
+	select {
+	case <-previous.txTracker.stopped:
+	default:
+		t.Fatal("previous tracker not stopped")
+	}
+}
+
+func TestTxTrackerMaxTracked(t *testing.T) {
+	buildTestConfig("NAIVE", "http://test1.com")
+
+	tracker := newTxTracker(&TxTrackerConfig{Enabled: true, MaxTracked: 1})
+
+	tracker.track(sendRawTransactionRequest(), []byte(`{"jsonrpc":"2.0","id":1,"result":"0x01"}`))
+	tracker.track(sendRawTransactionRequest(), []byte(`{"jsonrpc":"2.0","id":1,"result":"0x02"}`))
+
+	assert.Equal(t, 1, len(tracker.list("")))
+
+	_, exist := tracker.get("0x02")
+	assert.False(t, exist)
+}
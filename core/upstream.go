@@ -4,46 +4,169 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // the handle function will execute concurrently
 type Upstream interface {
-	handle(*Request) ([]byte, error)
+	handle(context.Context, *Request) ([]byte, error)
+	state() *upstreamState
+}
+
+const (
+	upstreamEnabled int32 = iota
+	upstreamDraining
+	upstreamDisabled
+)
+
+// upstreamState keeps the runtime information shared by all kinds of upstream
+type upstreamState struct {
+	config      *UpstreamConfig
+	url         string
+	name        string // url without path and query, safe to be shown in logs and metrics
+	status      int32
+	inFlight    int64
+	latency     int64 // nanoseconds cost of the last finished request
+	failed      int32 // 1 if the last finished request failed
+	blockNumber int64
+	headPushed  int64 // unix nano when a newHeads subscription pushed blockNumber
+	lagging     int32 // 1 if the upstream is too far behind the head
+	breaker     *circuitBreaker
+	auth        *upstreamAuth
+
+	rateLimitedUntil int64 // unix nano, set by 429 responses
+}
+
+// a provider asking to wait longer is treated as unavailable for this long at most
+const maxRateLimitBackoff = 10 * time.Minute
+
+func newUpstreamState(u *url.URL, cfg *UpstreamConfig) upstreamState {
+	name := u.Scheme + "://" + u.Host
+
+	return upstreamState{
+		config:  cfg,
+		url:     u.String(),
+		name:    name,
+		breaker: newCircuitBreaker(name, cfg.CircuitBreaker),
+		auth:    newUpstreamAuth(cfg.Auth),
+	}
+}
+
+func (s *upstreamState) state() *upstreamState {
+	return s
+}
+
+// an upstream not enabled, rate limited, or with an open circuit, should not receive new requests
+func (s *upstreamState) isAvailable() bool {
+	return atomic.LoadInt32(&s.status) == upstreamEnabled && !s.isRateLimited() && s.breaker.ready()
+}
+
+func (s *upstreamState) isHealthy() bool {
+	return s.isAvailable() && s.breaker.stateText() == "closed" && atomic.LoadInt32(&s.failed) == 0 && !s.isLagging()
+}
+
+func (s *upstreamState) setStatus(status int32) {
+	atomic.StoreInt32(&s.status, status)
+}
+
+func (s *upstreamState) statusText() string {
+	switch atomic.LoadInt32(&s.status) {
+	case upstreamDraining:
+		if atomic.LoadInt64(&s.inFlight) == 0 {
+			return "drained"
+		}
+		return "draining"
+	case upstreamDisabled:
+		return "disabled"
+	default:
+		return "enabled"
+	}
+}
+
+// begin marks a request in flight and starts its span,
+// the returned function should be called with the request result.
+// It returns CircuitOpenError if the circuit breaker doesn't let the request through.
+func (s *upstreamState) begin(ctx context.Context, request *Request) (context.Context, func(error), error) {
+	probe, ok := s.breaker.acquire()
+
+	if !ok {
+		return ctx, nil, CircuitOpenError
+	}
+
+	startAt := time.Now()
+	atomic.AddInt64(&s.inFlight, 1)
+
+	ctx, span := startSpan(ctx, "upstream.call", trace.WithAttributes(
+		attribute.String("upstream", s.name),
+		attribute.String("rpc.method", request.data.Method),
+	))
+
+	return ctx, func(err error) {
+		s.breaker.record(probe, err)
+		endSpan(span, err)
+		atomic.AddInt64(&s.inFlight, -1)
+		observeUpstreamRequest(s.name, startAt, err)
+
+		// a cancelled call tells nothing about the upstream
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+
+		atomic.StoreInt64(&s.latency, int64(time.Since(startAt)))
+
+		if err != nil {
+			atomic.StoreInt32(&s.failed, 1)
+		} else {
+			atomic.StoreInt32(&s.failed, 0)
+		}
+	}, nil
 }
 
 type wsProxyRequest struct {
 	*Request
 	id       int64
 	resBytes chan []byte
+	finished chan struct{} // closed when the caller stops waiting for the response
+	lost     chan struct{} // closed when the connection the request was sent on is lost
 }
 
 type wsProxyResponse struct {
 	ID int64 `json:"id"`
+	// a notification of the newHeads subscription has no id
+	Method string `json:"method"`
+	Params *struct {
+		Result struct {
+			Number string `json:"number"`
+		} `json:"result"`
+	} `json:"params"`
 }
 
 type WsUpstream struct {
-	url          string
+	upstreamState
 	requestQueue chan *wsProxyRequest
 	nextID       int64     // proxy request id
 	requests     *sync.Map // proxy request id => proxy request
 }
 
 type HttpUpstream struct {
-	ctx         context.Context
-	url         string
-	oldTrieUrl  string
-	blockNumber int
+	upstreamState
+	client *http.Client
 }
 
 type BlockNumberResponseData struct {
@@ -52,29 +175,23 @@ type BlockNumberResponseData struct {
 	Result  string `json:"result"`
 }
 
-func newUpstream(ctx context.Context, urlString string, oldTrieUrlString string) Upstream {
+func newUpstream(ctx context.Context, urlString string, cfg *UpstreamConfig) Upstream {
 	u, err := url.Parse(urlString)
 
 	if err != nil {
 		panic(err)
 	}
 
-	ou := u
+	var up Upstream
 
-	if urlString != oldTrieUrlString {
-		ou, err = url.Parse(oldTrieUrlString)
+	if u.Scheme == "http" || u.Scheme == "https" {
+		up, err = newHttpUpstream(u, cfg)
 
 		if err != nil {
 			panic(err)
 		}
-	}
-
-	var up Upstream
-
-	if u.Scheme == "http" || u.Scheme == "https" {
-		up = newHttpUpstream(ctx, u, ou)
 	} else if u.Scheme == "ws" || u.Scheme == "wss" {
-		up = newWsStream(ctx, u)
+		up = newWsStream(ctx, u, cfg)
 	} else {
 		panic(fmt.Errorf("unsuportted url schema %s", u.Scheme))
 	}
@@ -82,85 +199,363 @@ func newUpstream(ctx context.Context, urlString string, oldTrieUrlString string)
 	return up
 }
 
-func (u *HttpUpstream) handle(request *Request) ([]byte, error) {
-	ul := u.url
+// idempotent methods can be sent again when an attempt fails
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case "eth_sendRawTransaction", "eth_sendTransaction", "eth_sign", "eth_signTransaction",
+		"eth_newFilter", "eth_newBlockFilter", "eth_newPendingTransactionFilter",
+		"eth_uninstallFilter", "eth_getFilterChanges", "eth_subscribe", "eth_unsubscribe":
+		return false
+	}
+
+	for _, prefix := range []string{"personal_", "admin_", "miner_", "engine_"} {
+		if strings.HasPrefix(method, prefix) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// retryBackoff is an exponential backoff with full jitter
+func retryBackoff(cfg *UpstreamConfig, attempt int) time.Duration {
+	backoff := cfg.retryBackoff() << uint(attempt)
+
+	if backoff <= 0 || backoff > cfg.maxRetryBackoff() {
+		backoff = cfg.maxRetryBackoff()
+	}
+
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// withRetry runs the attempt of an upstream request, and retries idempotent methods
+// until the retries are used up or the request deadline is exceeded.
+// Each attempt has its own timeout.
+func withRetry(ctx context.Context, request *Request, cfg *UpstreamConfig, attempt func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	retries := 0
 
-	if request.isOldTrieRequest(u.blockNumber) {
-		ul = u.oldTrieUrl
+	if isIdempotentMethod(request.data.Method) {
+		retries = cfg.Retries
+	}
+
+	for i := 0; ; i++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, cfg.requestTimeout())
+		bts, err := attempt(attemptCtx)
+		cancel()
+
+		// the circuit won't close and the rate limit won't be lifted while retrying,
+		// leave it to the strategy to try another upstream
+		if err == nil || err == CircuitOpenError || err == RateLimitedError || i >= retries {
+			return bts, err
+		}
+
+		backoff := retryBackoff(cfg, i)
+		request.logger.Debugf("upstream attempt %d failed: %v, retry after %v", i+1, err, backoff)
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// contextError converts the error of a finished context
+func contextError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return TimeoutError
+	}
+
+	return ctx.Err()
+}
+
+func (u *HttpUpstream) handle(ctx context.Context, request *Request) ([]byte, error) {
+	return withRetry(ctx, request, u.config, func(ctx context.Context) ([]byte, error) {
+		return u.do(ctx, request)
+	})
+}
+
+func (u *HttpUpstream) do(ctx context.Context, request *Request) (_ []byte, err error) {
+	ctx, done, err := u.begin(ctx, request)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { done(err) }()
+
+	header, err := u.header()
+
+	if err != nil {
+		return nil, err
+	}
+
+	upstreamReq, _ := http.NewRequestWithContext(ctx, "POST", u.url, bytes.NewReader(request.reqBytes))
+
+	for k, v := range header {
+		upstreamReq.Header[k] = v
 	}
 
-	upstreamReq, _ := http.NewRequest("POST", ul, bytes.NewReader(request.reqBytes))
 	upstreamReq.Header.Set("Content-Type", "application/json")
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(upstreamReq.Header))
 
-	res, err := httpClient.Do(upstreamReq)
+	res, err := u.client.Do(upstreamReq)
 
 	if err != nil {
-		logrus.Errorf("http upstream client do request error: %+v", err)
+		if ctx.Err() != nil {
+			request.logger.Debugf("http upstream %s request stopped: %v", u.name, ctx.Err())
+			return nil, contextError(ctx)
+		}
+
+		upstreamLog.Errorf("http upstream client do request error: %+v", err)
 		return nil, err
 	}
 
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusTooManyRequests {
+		backoff := u.setRateLimited(res.Header.Get("Retry-After"))
+		upstreamLog.Warnf("http upstream %s rate limited, back off for %v", u.name, backoff)
+		return nil, RateLimitedError
+	}
+
 	bts, err := ioutil.ReadAll(res.Body)
 
 	if err != nil {
-		logrus.Errorf("http upstream io readall error: %+v", err)
+		upstreamLog.Errorf("http upstream io readall error: %+v", err)
+		return nil, err
+	}
+
+	if err := validateHttpResponse(res, bts); err != nil {
+		upstreamLog.Errorf("http upstream %s %v", u.name, err)
 		return nil, err
 	}
 
 	return bts, nil
 }
 
-func (u *WsUpstream) handle(request *Request) ([]byte, error) {
+// validateHttpResponse makes sure the body is a json-rpc response, or a batch of them,
+// a json-rpc error is accepted whatever the status is
+func validateHttpResponse(res *http.Response, bts []byte) error {
+	contentType := strings.ToLower(res.Header.Get("Content-Type"))
+
+	// some nodes don't set the content type, or send json as text/plain
+	if contentType != "" && !strings.Contains(contentType, "json") && !strings.HasPrefix(contentType, "text/plain") {
+		return fmt.Errorf("%w: status %d, content type %s", InvalidResponseError, res.StatusCode, contentType)
+	}
+
+	if classifyResponse(bts, nil) == responseTransportError {
+		return fmt.Errorf("%w: status %d, body is not a json-rpc response", InvalidResponseError, res.StatusCode)
+	}
+
+	return nil
+}
+
+// retryAfter parses the Retry-After header, which is in seconds or a http date
+func retryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(strings.TrimSpace(header)); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(header); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+
+		return 0, true
+	}
+
+	return 0, false
+}
+
+// setRateLimited stops sending requests to the upstream until the Retry-After time,
+// or the max retry backoff if the header is absent
+func (s *upstreamState) setRateLimited(header string) time.Duration {
+	now := time.Now()
+	backoff, ok := retryAfter(header, now)
+
+	if !ok {
+		backoff = s.config.maxRetryBackoff()
+	}
+
+	if backoff > maxRateLimitBackoff {
+		backoff = maxRateLimitBackoff
+	}
+
+	atomic.StoreInt64(&s.rateLimitedUntil, now.Add(backoff).UnixNano())
+
+	return backoff
+}
+
+func (s *upstreamState) isRateLimited() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&s.rateLimitedUntil)
+}
+
+func (u *WsUpstream) handle(ctx context.Context, request *Request) ([]byte, error) {
+	return withRetry(ctx, request, u.config, func(ctx context.Context) ([]byte, error) {
+		bts, err := u.do(ctx, request)
+
+		// sent again on another connection, the node may never have received it
+		if err == ConnectionLostError && isIdempotentMethod(request.data.Method) {
+			request.logger.Debugf("ws upstream %s connection lost, send again", u.name)
+			return u.do(ctx, request)
+		}
+
+		return bts, err
+	})
+}
+
+func (u *WsUpstream) do(ctx context.Context, request *Request) (_ []byte, err error) {
+	ctx, done, err := u.begin(ctx, request)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { done(err) }()
+
 	proxyRequest := &wsProxyRequest{
 		request,
 		atomic.AddInt64(&u.nextID, 1),
-		make(chan []byte),
+		make(chan []byte, 1),
+		make(chan struct{}),
+		make(chan struct{}),
 	}
 
 	u.requests.Store(proxyRequest.id, proxyRequest)
 	defer u.requests.Delete(proxyRequest.id)
+	defer close(proxyRequest.finished)
+
+	_, queueSpan := startSpan(ctx, "upstream.queue")
 
 	select {
 	case u.requestQueue <- proxyRequest:
-	case <-time.After(5 * time.Second): // TODO use a configurable timeout
-		return nil, TimeoutError
+		endSpan(queueSpan, nil)
+	case <-ctx.Done():
+		endSpan(queueSpan, contextError(ctx))
+		return nil, contextError(ctx)
 	}
 
 	select {
 	case res := <-proxyRequest.resBytes:
-		return res, nil
-	case <-time.After(5 * time.Second): // TODO use a configurable timeout
-		return nil, TimeoutError
+		return withRequestID(res, request), nil
+	case <-proxyRequest.lost:
+		// the response may arrive right before the connection is lost
+		select {
+		case res := <-proxyRequest.resBytes:
+			return withRequestID(res, request), nil
+		default:
+			return nil, ConnectionLostError
+		}
+	case <-ctx.Done():
+		return nil, contextError(ctx)
+	}
+}
+
+// withRequestID replaces the proxy id in a response with the id of the client request
+func withRequestID(bts []byte, request *Request) []byte {
+	var res map[string]json.RawMessage
+
+	if json.Unmarshal(bts, &res) != nil {
+		return bts
+	}
+
+	var req struct {
+		ID json.RawMessage `json:"id"`
+	}
+
+	_ = json.Unmarshal(request.reqBytes, &req)
+
+	if len(req.ID) == 0 {
+		req.ID, _ = json.Marshal(request.data.ID)
+	}
+
+	res["id"] = req.ID
+
+	restored, err := json.Marshal(res)
+
+	if err != nil {
+		return bts
+	}
+
+	return restored
+}
+
+// reconnectBackoff returns the delay before reconnecting after attempt failures,
+// it doubles on each failure with jitter, so the connections of a pool don't reconnect at once
+func reconnectBackoff(cfg *UpstreamConfig, attempt int) time.Duration {
+	backoff := cfg.reconnectDelay() << uint(attempt)
+
+	if backoff <= 0 || backoff > cfg.maxReconnectDelay() {
+		backoff = cfg.maxReconnectDelay()
 	}
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
 }
 
-func (u *WsUpstream) run(ctx context.Context) {
-	logrus.Debugf("ws %s run", u.url)
-	defer logrus.Debugf("ws %s run exit", u.url)
+// run keeps one connection of the pool, the connections take requests from the shared queue
+func (u *WsUpstream) run(ctx context.Context, index int) {
+	upstreamLog.Debugf("ws %s connection %d run", u.url, index)
+	defer upstreamLog.Debugf("ws %s connection %d run exit", u.url, index)
+
+	// the transport config is checked when the config is built
+	proxy, _ := u.config.transport().proxy()
+	tlsConfig, _ := u.config.transport().TLS.build()
+
+	dialer := &websocket.Dialer{
+		Proxy:            proxy,
+		HandshakeTimeout: u.config.connectTimeout(),
+		TLSClientConfig:  tlsConfig,
+	}
+
+	failures := 0
 
 	for {
-		conn, _, err := websocket.DefaultDialer.Dial(u.url, nil)
+		// the jwt of each dial is fresh
+		header, err := u.header()
 
-		if err != nil {
-			seconds := 5 // TODO configurable
-			logrus.Errorf("ws upstream %s %v, will retry after %d seconds", u.url, err, seconds)
+		var conn *websocket.Conn
 
-			select {
-			case <-ctx.Done():
+		if err == nil {
+			conn, _, err = dialer.DialContext(ctx, u.url, header)
+		}
+
+		if err == nil {
+			connectedAt := time.Now()
+
+			upstreamLog.Infof("ws upstream %s connection %d connected", u.url, index)
+			upstreamWebsocketConnections.WithLabelValues(u.name).Inc()
+			u.runConn(ctx, conn)
+			upstreamWebsocketConnections.WithLabelValues(u.name).Dec()
+
+			if ctx.Err() != nil {
 				// global stop
 				return
-			case <-time.After(time.Second * time.Duration(seconds)):
+			}
+
+			// a connection closed right after it's established counts as a failure, not to hammer the node
+			if time.Since(connectedAt) >= u.config.reconnectDelay() {
+				upstreamLog.Warnf("ws upstream %s connection %d lost, reconnect", u.url, index)
+				failures = 0
 				continue
 			}
 
+			err = fmt.Errorf("connection %d closed right after connected", index)
 		}
 
-		logrus.Infof("ws upstream %s connected", u.url)
-		u.runConn(ctx, conn)
+		delay := reconnectBackoff(u.config, failures)
+		failures++
+		upstreamLog.Errorf("ws upstream %s %v, will retry after %v", u.url, err, delay)
 
 		select {
 		case <-ctx.Done():
 			// global stop
 			return
+		case <-time.After(delay):
 		}
 	}
 }
@@ -173,25 +568,99 @@ func (u *WsUpstream) runConn(ctx context.Context, conn *websocket.Conn) {
 	// any error occurs, the context will be cancelled
 	connContext, done := context.WithCancel(ctx)
 
+	// requests sent on this connection and still waited for, they fail at once when the connection is lost
+	sent := &sync.Map{}
+
+	defer sent.Range(func(_, r interface{}) bool {
+		close(r.(*wsProxyRequest).lost)
+		return true
+	})
+
+	// a dead socket is closed when neither the pong nor anything else is received in time
+	pingInterval := u.config.pingInterval()
+	extendReadDeadline := func() error {
+		return conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+	}
+
+	_ = extendReadDeadline()
+	conn.SetPongHandler(func(string) error { return extendReadDeadline() })
+
+	go func() {
+		defer done()
+
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-connContext.Done():
+				return
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pingInterval)); err != nil {
+					upstreamLog.Errorf("ping upstream %s failed %v", u.name, err)
+					return
+				}
+			}
+		}
+	}()
+
+	// the head is pushed by the node, it's polled only if the subscription is not supported
+	subscribe, _ := json.Marshal(newInternalRequest("eth_subscribe", "newHeads").data)
+
+	if err := conn.WriteMessage(websocket.TextMessage, subscribe); err != nil {
+		upstreamLog.Errorf("subscribe new heads of %s failed %v", u.name, err)
+	}
+
+	// a slot is taken by each request sent on this connection until its caller stops waiting,
+	// the connection takes no more requests from the queue when all slots are taken
+	var slots chan struct{}
+
+	if max := u.config.MaxInFlightPerConnection; max > 0 {
+		slots = make(chan struct{}, max)
+	}
+
 	// request loop
+	requestLoopStopped := make(chan struct{})
+
 	go func() {
-		logrus.Debugf("conn request loop start")
-		defer logrus.Debugf("conn request loop stop")
+		upstreamLog.Debugf("conn request loop start")
+		defer upstreamLog.Debugf("conn request loop stop")
+		defer close(requestLoopStopped)
 		defer done()
 		for {
+			if slots != nil {
+				select {
+				case <-connContext.Done():
+					return
+				case slots <- struct{}{}:
+				}
+			}
+
 			select {
 			case <-connContext.Done():
 				// if the conn is invalid, exit
 				return
 			case wsProxyRequest := <-u.requestQueue:
-				// use proxy ID
-				wsProxyRequest.Request.data.ID = wsProxyRequest.id
+				sent.Store(wsProxyRequest.id, wsProxyRequest)
+
+				go func() {
+					<-wsProxyRequest.finished
+					sent.Delete(wsProxyRequest.id)
+
+					if slots != nil {
+						<-slots
+					}
+				}()
+
+				// use proxy ID, the request may be sent to other upstreams at the same time
+				data := *wsProxyRequest.Request.data
+				data.ID = wsProxyRequest.id
 
-				bts, _ := json.Marshal(wsProxyRequest.Request.data)
+				bts, _ := json.Marshal(&data)
 				err := conn.WriteMessage(websocket.TextMessage, bts)
 
 				if err != nil {
-					logrus.Errorf("write request to upstream failed %v", err)
+					upstreamLog.Errorf("write request to upstream failed %v", err)
 					return
 				}
 			}
@@ -201,26 +670,38 @@ func (u *WsUpstream) runConn(ctx context.Context, conn *websocket.Conn) {
 
 	// response loop
 	go func() {
-		logrus.Debugf("conn response loop start")
-		defer logrus.Debugf("conn response loop stop")
+		upstreamLog.Debugf("conn response loop start")
+		defer upstreamLog.Debugf("conn response loop stop")
 		defer done()
 
 		for {
 			t, p, err := conn.ReadMessage()
 
 			if err != nil {
-				logrus.Errorf("read response from upstream failed %v", err)
+				upstreamLog.Errorf("read response from upstream failed %v", err)
 				break
 			}
 
+			_ = extendReadDeadline()
+
 			if t != websocket.TextMessage {
-				logrus.Infof("not a text message %v", p)
+				upstreamLog.Infof("not a text message %v", p)
 				continue
 			}
 
 			var res wsProxyResponse
 			_ = json.Unmarshal(p, &res)
 
+			if res.Method == "eth_subscription" && res.Params != nil {
+				if blockNumber, err := strconv.ParseInt(res.Params.Result.Number, 0, 64); err == nil {
+					u.pushHead(blockNumber)
+				}
+
+				continue
+			}
+
+			sent.Delete(res.ID)
+
 			if r, exist := u.requests.Load(res.ID); exist {
 				if req, ok := r.(*wsProxyRequest); ok {
 					req.resBytes <- p
@@ -230,56 +711,40 @@ func (u *WsUpstream) runConn(ctx context.Context, conn *websocket.Conn) {
 	}()
 
 	<-connContext.Done()
-}
-
-func newHttpUpstream(ctx context.Context, url *url.URL, oldTrieUrl *url.URL) *HttpUpstream {
-	up := &HttpUpstream{
-		ctx:        ctx,
-		url:        url.String(),
-		oldTrieUrl: oldTrieUrl.String(),
-	}
-
-	if url != oldTrieUrl {
-		setBlockNumber := func() {
-			req := getBlockNumberRequest()
-			bts, _ := up.handle(req)
-
-			var res BlockNumberResponseData
-			_ = json.Unmarshal(bts, &res)
-
-			blockNumber, _ := strconv.ParseInt(res.Result, 0, 64)
-			up.blockNumber = int(blockNumber)
 
-		}
+	// no more requests are sent once the request loop stops, the blocked write fails on the closed socket
+	_ = conn.Close()
+	<-requestLoopStopped
+}
 
-		go func() {
-			time.Sleep(5 * time.Second)
-			setBlockNumber()
-		}()
+func newHttpUpstream(url *url.URL, cfg *UpstreamConfig) (*HttpUpstream, error) {
+	client, err := createHTTPClient(cfg)
 
-		logrus.Infof("start old trie http upstream, blockNumber: %d", up.blockNumber)
+	if err != nil {
+		return nil, err
+	}
 
-		go func() {
-			for {
-				setBlockNumber()
-				time.Sleep(30 * time.Second)
-			}
-		}()
+	up := &HttpUpstream{
+		upstreamState: newUpstreamState(url, cfg),
+		client:        client,
 	}
 
-	return up
+	return up, nil
 }
 
-func newWsStream(ctx context.Context, url *url.URL) *WsUpstream {
+func newWsStream(ctx context.Context, url *url.URL, cfg *UpstreamConfig) *WsUpstream {
 	upstream := &WsUpstream{
-		url:          url.String(),
-		requestQueue: make(chan *wsProxyRequest),
-		nextID:       time.Now().Unix(),
-		requests:     &sync.Map{},
+		upstreamState: newUpstreamState(url, cfg),
+		requestQueue:  make(chan *wsProxyRequest),
+		nextID:        time.Now().Unix(),
+		requests:      &sync.Map{},
 	}
 
-	logrus.Infof("new upstream %s", url)
-	go upstream.run(ctx)
+	upstreamLog.Infof("new upstream %s", url)
+
+	for i := 0; i < cfg.connections(); i++ {
+		go upstream.run(ctx, i)
+	}
 
 	return upstream
 }
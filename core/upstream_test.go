@@ -2,23 +2,32 @@ package core
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestNewUpstream(t *testing.T) {
 
-	upstream1 := newUpstream(context.Background(), "http://test1.com", "http://test2.com")
+	upstream1 := newUpstream(context.Background(), "http://test1.com", &UpstreamConfig{})
 	assert.IsType(t, &HttpUpstream{}, upstream1)
 
-	upstream2 := newUpstream(context.Background(), "ws://test1.com", "ws://test2.com")
+	upstream2 := newUpstream(context.Background(), "ws://test1.com", &UpstreamConfig{})
 	assert.IsType(t, &WsUpstream{}, upstream2)
 
-	assert.Panics(t, func() { newUpstream(context.Background(), "xxx://test1.com", "xxx://test2.com") })
+	assert.Panics(t, func() { newUpstream(context.Background(), "xxx://test1.com", &UpstreamConfig{}) })
 }
 
 func TestNewHttpUpstream(t *testing.T) {
@@ -28,15 +37,9 @@ func TestNewHttpUpstream(t *testing.T) {
 		panic(err)
 	}
 
-	url2, err := url.Parse("http://test2.com")
-
-	if err != nil {
-		panic(err)
-	}
-
-	upstream1 := newHttpUpstream(context.Background(), url1, url2)
+	upstream1, err := newHttpUpstream(url1, &UpstreamConfig{})
+	assert.Nil(t, err)
 	assert.Equal(t, upstream1.url, "http://test1.com")
-	assert.Equal(t, upstream1.oldTrieUrl, "http://test2.com")
 }
 
 func TestHttpHandle(t *testing.T) {
@@ -46,13 +49,7 @@ func TestHttpHandle(t *testing.T) {
 		panic(err)
 	}
 
-	url2, err := url.Parse("https://ropsten.infura.io/v3/83438c4dcf834ceb8944162688749707")
-
-	if err != nil {
-		panic(err)
-	}
-
-	upstream1 := newHttpUpstream(context.Background(), url1, url2)
+	upstream1, _ := newHttpUpstream(url1, &UpstreamConfig{})
 
 	reqBodyBytes1 := []byte(fmt.Sprintf(`{"params": [], "method": "eth_blockNumber", "id": %d, "jsonrpc": "2.0"}`, time.Now().Unix()))
 	req1, err := newRequest(reqBodyBytes1)
@@ -61,7 +58,7 @@ func TestHttpHandle(t *testing.T) {
 		panic(err)
 	}
 
-	bts, err := upstream1.handle(req1)
+	bts, err := upstream1.handle(context.Background(), req1)
 
 	if err != nil {
 		panic(err)
@@ -77,7 +74,7 @@ func TestNewWsUpstream(t *testing.T) {
 		panic(err)
 	}
 
-	upstream1 := newWsStream(context.Background(), url1)
+	upstream1 := newWsStream(context.Background(), url1, &UpstreamConfig{})
 	assert.Equal(t, upstream1.url, "http://test1.com")
 }
 
@@ -88,7 +85,7 @@ func TestWsHandle(t *testing.T) {
 		panic(err)
 	}
 
-	upstream1 := newWsStream(context.Background(), url1)
+	upstream1 := newWsStream(context.Background(), url1, &UpstreamConfig{})
 
 	reqBodyBytes1 := []byte(fmt.Sprintf(`{"params": [], "method": "eth_blockNumber", "id": %d, "jsonrpc": "2.0"}`, time.Now().Unix()))
 	req1, err := newRequest(reqBodyBytes1)
@@ -97,7 +94,7 @@ func TestWsHandle(t *testing.T) {
 		panic(err)
 	}
 
-	bts, err := upstream1.handle(req1)
+	bts, err := upstream1.handle(context.Background(), req1)
 
 	assert.NotEqual(t, nil, err)
 
@@ -107,7 +104,7 @@ func TestWsHandle(t *testing.T) {
 		panic(err)
 	}
 
-	upstream2 := newWsStream(context.Background(), url2)
+	upstream2 := newWsStream(context.Background(), url2, &UpstreamConfig{})
 
 	reqBodyBytes2 := []byte(fmt.Sprintf(`{"params": [], "method": "eth_blockNumber", "id": %d, "jsonrpc": "2.0"}`, time.Now().Unix()))
 	req2, err := newRequest(reqBodyBytes2)
@@ -116,7 +113,7 @@ func TestWsHandle(t *testing.T) {
 		panic(err)
 	}
 
-	bts, err = upstream2.handle(req2)
+	bts, err = upstream2.handle(context.Background(), req2)
 
 	assert.Equal(t, TimeoutError, err)
 
@@ -130,12 +127,12 @@ func TestWsRun(t *testing.T) {
 		panic(err)
 	}
 
-	upstream2 := newWsStream(context.Background(), url2)
+	upstream2 := newWsStream(context.Background(), url2, &UpstreamConfig{})
 
 	timeout := time.After(5 * time.Second)
 	done := make(chan bool)
 	go func() {
-		upstream2.run(context.Background())
+		upstream2.run(context.Background(), 0)
 		done <- true
 	}()
 
@@ -146,3 +143,442 @@ func TestWsRun(t *testing.T) {
 		assert.True(t, true)
 	}
 }
+
+// newWsTestServer calls handle with every request of a connection, the connections are numbered from 0.
+// A response is written for each non-nil result.
+func newWsTestServer(handle func(conn int, data RequestData) []byte) *httptest.Server {
+	var conns int32
+	upgrader := websocket.Upgrader{}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+
+		if err != nil {
+			return
+		}
+
+		defer c.Close()
+
+		index := int(atomic.AddInt32(&conns, 1) - 1)
+
+		var lock sync.Mutex
+
+		for {
+			_, p, err := c.ReadMessage()
+
+			if err != nil {
+				return
+			}
+
+			var data RequestData
+			_ = json.Unmarshal(p, &data)
+
+			go func() {
+				if bts := handle(index, data); bts != nil {
+					lock.Lock()
+					defer lock.Unlock()
+					_ = c.WriteMessage(websocket.TextMessage, bts)
+				}
+			}()
+		}
+	}))
+}
+
+func wsTestUrl(server *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func TestWsUpstreamResponseID(t *testing.T) {
+	server := newWsTestServer(func(conn int, data RequestData) []byte {
+		return []byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"result":"0x1"}`, data.ID))
+	})
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	u, _ := url.Parse(wsTestUrl(server))
+	upstream := newWsStream(ctx, u, &UpstreamConfig{})
+
+	buildTestConfig("NAIVE", "http://test1.com")
+
+	for _, id := range []string{`7`, `"abc"`} {
+		req, _ := newRequest([]byte(`{"params": [], "method": "eth_blockNumber", "id": ` + id + `, "jsonrpc": "2.0"}`))
+		bts, err := upstream.handle(context.Background(), req)
+
+		assert.Nil(t, err)
+		assert.Equal(t, `{"id":`+id+`,"jsonrpc":"2.0","result":"0x1"}`, string(bts))
+	}
+}
+
+func TestWsUpstreamPool(t *testing.T) {
+	var lock sync.Mutex
+	received := map[int]int{}
+	release := make(chan struct{})
+
+	server := newWsTestServer(func(conn int, data RequestData) []byte {
+		if data.Method != "eth_blockNumber" {
+			return nil
+		}
+
+		lock.Lock()
+		received[conn]++
+		lock.Unlock()
+
+		<-release
+
+		return []byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"result":"0x1"}`, data.ID))
+	})
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	u, _ := url.Parse(wsTestUrl(server))
+	upstream := newWsStream(ctx, u, &UpstreamConfig{Connections: 2, MaxInFlightPerConnection: 1})
+
+	buildTestConfig("NAIVE", "http://test1.com")
+
+	var wg sync.WaitGroup
+	var succeeded int32
+
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			req, _ := newRequest([]byte(`{"params": [], "method": "eth_blockNumber", "id": 1, "jsonrpc": "2.0"}`))
+			bts, err := upstream.handle(context.Background(), req)
+
+			if err == nil && strings.Contains(string(bts), `"0x1"`) {
+				atomic.AddInt32(&succeeded, 1)
+			}
+		}()
+	}
+
+	// each connection has one request in flight, the third one waits in the queue
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return received[0] == 1 && received[1] == 1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	time.Sleep(50 * time.Millisecond)
+
+	lock.Lock()
+	assert.Equal(t, 2, received[0]+received[1])
+	lock.Unlock()
+
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&succeeded))
+}
+
+func TestWsUpstreamConnectionLost(t *testing.T) {
+	var conns, breaking int32 = 0, 1
+	upgrader := websocket.Upgrader{}
+
+	// the connection breaks on a request if breaking is set, otherwise it answers
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+
+		if err != nil {
+			return
+		}
+
+		defer c.Close()
+
+		atomic.AddInt32(&conns, 1)
+
+		for {
+			_, p, err := c.ReadMessage()
+
+			if err != nil {
+				return
+			}
+
+			var data RequestData
+			_ = json.Unmarshal(p, &data)
+
+			if data.Method == "eth_subscribe" {
+				continue
+			}
+
+			if atomic.CompareAndSwapInt32(&breaking, 1, 0) {
+				return
+			}
+
+			_ = c.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"result":"0x1"}`, data.ID)))
+		}
+	}))
+	defer server.Close()
+
+	buildTestConfig("NAIVE", "http://test1.com")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	u, _ := url.Parse(wsTestUrl(server))
+	upstream := newWsStream(ctx, u, &UpstreamConfig{ReconnectDelayMs: 10})
+
+	// idempotent requests are sent again after reconnecting
+	startAt := time.Now()
+	req, _ := newRequest([]byte(`{"params": [], "method": "eth_blockNumber", "id": 1, "jsonrpc": "2.0"}`))
+	bts, err := upstream.handle(context.Background(), req)
+
+	assert.Nil(t, err)
+	assert.Contains(t, string(bts), `"0x1"`)
+	assert.True(t, time.Since(startAt) < time.Second)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&conns))
+
+	// the others fail at once
+	atomic.StoreInt32(&breaking, 1)
+
+	startAt = time.Now()
+	req, _ = newRequest([]byte(`{"params": ["0x00"], "method": "eth_sendRawTransaction", "id": 1, "jsonrpc": "2.0"}`))
+	_, err = upstream.handle(context.Background(), req)
+
+	assert.Equal(t, ConnectionLostError, err)
+	assert.True(t, time.Since(startAt) < time.Second)
+}
+
+func TestWsUpstreamPing(t *testing.T) {
+	var conns int32
+	upgrader := websocket.Upgrader{}
+
+	// the server never reads, so it never answers pings
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+
+		if err != nil {
+			return
+		}
+
+		defer c.Close()
+
+		atomic.AddInt32(&conns, 1)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	u, _ := url.Parse(wsTestUrl(server))
+	newWsStream(ctx, u, &UpstreamConfig{ReconnectDelayMs: 10, PingIntervalMs: 50})
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&conns) >= 2
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	cfg := &UpstreamConfig{ReconnectDelayMs: 100, MaxReconnectDelayMs: 1000}
+
+	for i := 0; i < 10; i++ {
+		backoff := reconnectBackoff(cfg, i)
+		expected := 100 * time.Millisecond << uint(i)
+
+		if expected > time.Second {
+			expected = time.Second
+		}
+
+		assert.True(t, backoff >= expected/2 && backoff <= expected, "attempt %d: %v", i, backoff)
+	}
+}
+
+func TestIsIdempotentMethod(t *testing.T) {
+	assert.True(t, isIdempotentMethod("eth_call"))
+	assert.True(t, isIdempotentMethod("eth_getBalance"))
+	assert.False(t, isIdempotentMethod("eth_sendRawTransaction"))
+	assert.False(t, isIdempotentMethod("personal_unlockAccount"))
+}
+
+func TestRetryBackoff(t *testing.T) {
+	cfg := &UpstreamConfig{RetryBackoffMs: 100, MaxRetryBackoffMs: 1000}
+
+	for i := 0; i < 100; i++ {
+		assert.True(t, retryBackoff(cfg, 0) <= 100*time.Millisecond)
+		assert.True(t, retryBackoff(cfg, 3) <= 800*time.Millisecond)
+		assert.True(t, retryBackoff(cfg, 10) <= 1000*time.Millisecond)
+		assert.True(t, retryBackoff(cfg, 100) <= 1000*time.Millisecond)
+	}
+}
+
+func newSlowTestServer(slowCalls int32, delay time.Duration) (*httptest.Server, *int32) {
+	var calls int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+
+		if atomic.AddInt32(&calls, 1) <= slowCalls {
+			time.Sleep(delay)
+		}
+
+		_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+
+	return server, &calls
+}
+
+func TestHttpUpstreamRetry(t *testing.T) {
+	server, calls := newSlowTestServer(2, 200*time.Millisecond)
+	defer server.Close()
+
+	buildTestConfig("NAIVE", server.URL)
+
+	u, _ := url.Parse(server.URL)
+	upstream, _ := newHttpUpstream(u, &UpstreamConfig{RequestTimeoutMs: 50, Retries: 2, RetryBackoffMs: 1})
+
+	req, _ := newRequest([]byte(`{"params": [], "method": "eth_blockNumber", "id": 1, "jsonrpc": "2.0"}`))
+	bts, err := upstream.handle(context.Background(), req)
+
+	assert.Nil(t, err)
+	assert.Contains(t, string(bts), "0x1")
+	assert.Equal(t, int32(3), atomic.LoadInt32(calls))
+
+	// not idempotent, no retry
+	atomic.StoreInt32(calls, 0)
+	req, _ = newRequest([]byte(`{"params": ["0x00"], "method": "eth_sendRawTransaction", "id": 1, "jsonrpc": "2.0"}`))
+	_, err = upstream.handle(context.Background(), req)
+
+	assert.Equal(t, TimeoutError, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(calls))
+}
+
+func TestRequestDeadline(t *testing.T) {
+	server, _ := newSlowTestServer(100, 300*time.Millisecond)
+	defer server.Close()
+
+	rcfg := buildTestConfig("NAIVE", server.URL)
+	rcfg.requestTimeout = 100 * time.Millisecond
+
+	req, _ := newRequest([]byte(`{"params": [], "method": "eth_blockNumber", "id": 1, "jsonrpc": "2.0"}`))
+
+	startAt := time.Now()
+	_, _, err := dispatch(context.Background(), req)
+
+	assert.Equal(t, TimeoutError, err)
+	assert.True(t, time.Since(startAt) < 250*time.Millisecond)
+}
+
+func TestHttpUpstreamResponseValidation(t *testing.T) {
+	var status int32 = http.StatusOK
+	var contentType atomic.Value
+	var body atomic.Value
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", contentType.Load().(string))
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+		_, _ = w.Write([]byte(body.Load().(string)))
+	}))
+	defer server.Close()
+
+	buildTestConfig("NAIVE", server.URL)
+
+	u, _ := url.Parse(server.URL)
+	upstream, _ := newHttpUpstream(u, &UpstreamConfig{})
+
+	cases := []struct {
+		status      int32
+		contentType string
+		body        string
+		valid       bool
+	}{
+		{http.StatusOK, "application/json", `{"jsonrpc":"2.0","id":1,"result":"0x1"}`, true},
+		{http.StatusOK, "text/plain; charset=utf-8", `{"jsonrpc":"2.0","id":1,"result":"0x1"}`, true},
+		{http.StatusBadRequest, "application/json", `{"jsonrpc":"2.0","id":1,"error":{"code":-32602,"message":"invalid argument"}}`, true},
+		{http.StatusBadGateway, "text/html", `<html><body>502 Bad Gateway</body></html>`, false},
+		{http.StatusOK, "text/html", `{"jsonrpc":"2.0","id":1,"result":"0x1"}`, false},
+		{http.StatusServiceUnavailable, "application/json", `{"message":"unavailable"}`, false},
+		{http.StatusOK, "application/json", `[{"jsonrpc":"2.0","id":1,"result":"0x1"},{"jsonrpc":"2.0","id":2,"error":{"code":3,"message":"execution reverted"}}]`, true},
+		{http.StatusOK, "application/json", `[]`, false},
+	}
+
+	for _, c := range cases {
+		atomic.StoreInt32(&status, c.status)
+		contentType.Store(c.contentType)
+		body.Store(c.body)
+
+		req, _ := newRequest([]byte(`{"params": [], "method": "eth_blockNumber", "id": 1, "jsonrpc": "2.0"}`))
+		bts, err := upstream.handle(context.Background(), req)
+
+		if c.valid {
+			assert.Nil(t, err, c.body)
+			assert.Equal(t, c.body, string(bts))
+		} else {
+			assert.True(t, errors.Is(err, InvalidResponseError), c.body)
+			assert.Equal(t, "invalid_response", upstreamErrorKind(err))
+		}
+	}
+}
+
+func TestHttpUpstreamBatchRequest(t *testing.T) {
+	var calls int32
+	batch := `[{"jsonrpc":"2.0","id":1,"result":"0x1"},{"jsonrpc":"2.0","id":2,"result":"0x2"}]`
+
+	server := newBodyTestServer(batch, &calls)
+	defer server.Close()
+
+	buildTestConfig("NAIVE", server.URL)
+
+	u, _ := url.Parse(server.URL)
+	upstream, _ := newHttpUpstream(u, &UpstreamConfig{Retries: 2, RetryBackoffMs: 1})
+
+	req, _ := newRequest([]byte(`[{"params": [], "method": "eth_blockNumber", "id": 1, "jsonrpc": "2.0"}, {"params": [], "method": "eth_chainId", "id": 2, "jsonrpc": "2.0"}]`))
+	bts, err := upstream.handle(context.Background(), req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, batch, string(bts))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestHttpUpstreamRateLimited(t *testing.T) {
+	var calls int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte(`<html>slow down</html>`))
+	}))
+	defer server.Close()
+
+	buildTestConfig("NAIVE", server.URL)
+
+	u, _ := url.Parse(server.URL)
+	upstream, _ := newHttpUpstream(u, &UpstreamConfig{Retries: 2, RetryBackoffMs: 1})
+
+	req, _ := newRequest([]byte(`{"params": [], "method": "eth_blockNumber", "id": 1, "jsonrpc": "2.0"}`))
+	_, err := upstream.handle(context.Background(), req)
+
+	// no retry on a rate limited upstream, and it's unavailable until the Retry-After time
+	assert.Equal(t, RateLimitedError, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	assert.True(t, upstream.isRateLimited())
+	assert.False(t, upstream.isAvailable())
+	assert.Equal(t, "closed", upstream.breaker.stateText())
+	assert.True(t, time.Duration(atomic.LoadInt64(&upstream.rateLimitedUntil)-time.Now().UnixNano()) > 900*time.Millisecond)
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	d, ok := retryAfter("120", now)
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Minute, d)
+
+	d, ok = retryAfter("Wed, 01 Jan 2020 00:00:30 GMT", now)
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, d)
+
+	_, ok = retryAfter("", now)
+	assert.False(t, ok)
+
+	_, ok = retryAfter("soon", now)
+	assert.False(t, ok)
+}
@@ -0,0 +1,122 @@
+package core
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebsocketConfig limits the websocket connections of clients
+type WebsocketConfig struct {
+	// values of the Origin header allowed to connect, all origins are allowed if it's empty or contains "*".
+	// Clients sending no Origin header, which are not browsers, are always allowed.
+	AllowedOrigins []string `json:"allowedOrigins,omitempty"`
+	// connections of a client ip, 0 is unlimited
+	MaxConnectionsPerIP int `json:"maxConnectionsPerIp,omitempty"`
+	// connections of an api key, 0 is unlimited
+	MaxConnectionsPerKey int `json:"maxConnectionsPerKey,omitempty"`
+	// requests of a connection handled at the same time, more requests wait to be read
+	MaxInFlight int `json:"maxInFlight,omitempty"`
+	// reply in the order of the requests, otherwise a reply is written once it's ready
+	Ordered bool `json:"ordered"`
+	// the client is pinged in this interval, and disconnected if nothing is received in two intervals
+	PingIntervalMs int `json:"pingIntervalMs,omitempty"`
+	// the client is disconnected if it sends no request in this long, 0 disables it
+	IdleTimeoutMs int `json:"idleTimeoutMs,omitempty"`
+}
+
+const (
+	defaultWsMaxInFlight  = 16
+	defaultWsPingInterval = 30 * time.Second
+)
+
+func (c *WebsocketConfig) checkOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+
+	if origin == "" || len(c.AllowedOrigins) == 0 {
+		return true
+	}
+
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// connectionCounter counts the websocket connections of each client,
+// it's kept across config reloads as the connections are
+type connectionCounter struct {
+	lock   sync.Mutex
+	counts map[string]int
+}
+
+var wsClientConnections = &connectionCounter{counts: make(map[string]int)}
+
+// acquire counts a connection of the key, it returns false if the key already has max connections.
+// An empty key or a max of 0 is unlimited.
+func (c *connectionCounter) acquire(key string, max int) bool {
+	if key == "" || max <= 0 {
+		return true
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.counts[key] >= max {
+		return false
+	}
+
+	c.counts[key]++
+
+	return true
+}
+
+func (c *connectionCounter) release(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.counts[key] <= 1 {
+		delete(c.counts, key)
+		return
+	}
+
+	c.counts[key]--
+}
+
+// acquireWsConnection counts a connection of the client, it returns the function releasing it,
+// or the rejection reason if the client has too many connections
+func acquireWsConnection(cfg *WebsocketConfig, req *http.Request) (func(), string) {
+	ipKey := "ip:" + clientIP(req)
+
+	if !wsClientConnections.acquire(ipKey, cfg.MaxConnectionsPerIP) {
+		return nil, "ip_limit"
+	}
+
+	var apiKey string
+
+	if key := clientAPIKey(req); key != "" {
+		apiKey = "key:" + key
+	}
+
+	if !wsClientConnections.acquire(apiKey, cfg.MaxConnectionsPerKey) {
+		if cfg.MaxConnectionsPerIP > 0 {
+			wsClientConnections.release(ipKey)
+		}
+
+		return nil, "key_limit"
+	}
+
+	return func() {
+		if cfg.MaxConnectionsPerIP > 0 {
+			wsClientConnections.release(ipKey)
+		}
+
+		if apiKey != "" && cfg.MaxConnectionsPerKey > 0 {
+			wsClientConnections.release(apiKey)
+		}
+	}, ""
+}
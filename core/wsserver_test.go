@@ -0,0 +1,194 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebsocketCheckOrigin(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	cfg := &WebsocketConfig{}
+
+	assert.True(t, cfg.checkOrigin(req))
+
+	req.Header.Set("Origin", "https://b.com")
+	assert.True(t, cfg.checkOrigin(req))
+
+	cfg.AllowedOrigins = []string{"https://A.com"}
+	assert.False(t, cfg.checkOrigin(req))
+
+	req.Header.Set("Origin", "https://a.com")
+	assert.True(t, cfg.checkOrigin(req))
+
+	// not a browser
+	req.Header.Del("Origin")
+	assert.True(t, cfg.checkOrigin(req))
+
+	cfg.AllowedOrigins = []string{"*"}
+	req.Header.Set("Origin", "https://b.com")
+	assert.True(t, cfg.checkOrigin(req))
+}
+
+func TestAcquireWsConnection(t *testing.T) {
+	cfg := &WebsocketConfig{MaxConnectionsPerIP: 2, MaxConnectionsPerKey: 1}
+
+	newReq := func(ip, key string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/ws?apiKey="+key, nil)
+		req.RemoteAddr = ip + ":1234"
+		return req
+	}
+
+	release1, _ := acquireWsConnection(cfg, newReq("10.0.0.1", "key1"))
+	assert.NotNil(t, release1)
+
+	_, reason := acquireWsConnection(cfg, newReq("10.0.0.1", "key1"))
+	assert.Equal(t, "key_limit", reason)
+
+	release2, _ := acquireWsConnection(cfg, newReq("10.0.0.1", ""))
+	assert.NotNil(t, release2)
+
+	_, reason = acquireWsConnection(cfg, newReq("10.0.0.1", "key2"))
+	assert.Equal(t, "ip_limit", reason)
+
+	release1()
+
+	release3, _ := acquireWsConnection(cfg, newReq("10.0.0.2", "key1"))
+	assert.NotNil(t, release3)
+
+	release2()
+	release3()
+
+	assert.Equal(t, 0, len(wsClientConnections.counts))
+}
+
+// newWsGatewayTestServer runs the gateway with an upstream answering the request id after (4 - id) * 50ms
+func newWsGatewayTestServer(t *testing.T, cfg WebsocketConfig) string {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bts, _ := ioutil.ReadAll(r.Body)
+
+		var data RequestData
+		_ = json.Unmarshal(bts, &data)
+
+		time.Sleep(time.Duration(4-data.ID) * 50 * time.Millisecond)
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"result":"0x1"}`, data.ID)))
+	}))
+	t.Cleanup(upstream.Close)
+
+	config := &Config{
+		Strategy:                "NAIVE",
+		Upstreams:               []*UpstreamConfig{{Url: upstream.URL}},
+		MethodLimitationEnabled: true,
+		AllowedMethods:          []string{"eth_blockNumber"},
+		Websocket:               cfg,
+	}
+
+	_, err := BuildRunningConfigFromConfig(context.Background(), config)
+	assert.Nil(t, err)
+
+	gateway := httptest.NewServer(&Server{})
+	t.Cleanup(gateway.Close)
+
+	return "ws" + strings.TrimPrefix(gateway.URL, "http") + "/ws"
+}
+
+func readWsReplyIDs(t *testing.T, conn *websocket.Conn, count int) []int64 {
+	ids := make([]int64, 0, count)
+
+	for i := 0; i < count; i++ {
+		_, p, err := conn.ReadMessage()
+		assert.Nil(t, err)
+
+		var res struct {
+			ID int64 `json:"id"`
+		}
+		_ = json.Unmarshal(p, &res)
+		ids = append(ids, res.ID)
+	}
+
+	return ids
+}
+
+func sendWsRequests(conn *websocket.Conn, ids ...int) {
+	for _, id := range ids {
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"params": [], "method": "eth_blockNumber", "id": %d, "jsonrpc": "2.0"}`, id)))
+	}
+}
+
+func TestServerWSConcurrentRequests(t *testing.T) {
+	url := newWsGatewayTestServer(t, WebsocketConfig{})
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	// the faster replies come first
+	sendWsRequests(conn, 1, 2, 3)
+	assert.Equal(t, []int64{3, 2, 1}, readWsReplyIDs(t, conn, 3))
+
+	// a denied request is answered without closing the connection
+	_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"params": [], "method": "admin_peers", "id": 4, "jsonrpc": "2.0"}`))
+	_, p, err := conn.ReadMessage()
+	assert.Nil(t, err)
+	assert.Contains(t, string(p), `"error"`)
+
+	sendWsRequests(conn, 3)
+	assert.Equal(t, []int64{3}, readWsReplyIDs(t, conn, 1))
+}
+
+func TestServerWSOrderedReplies(t *testing.T) {
+	url := newWsGatewayTestServer(t, WebsocketConfig{Ordered: true})
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	startAt := time.Now()
+	sendWsRequests(conn, 1, 2, 3)
+
+	assert.Equal(t, []int64{1, 2, 3}, readWsReplyIDs(t, conn, 3))
+	// still handled at the same time
+	assert.True(t, time.Since(startAt) < 250*time.Millisecond)
+}
+
+func TestServerWSLimits(t *testing.T) {
+	url := newWsGatewayTestServer(t, WebsocketConfig{AllowedOrigins: []string{"https://a.com"}, MaxConnectionsPerIP: 1, IdleTimeoutMs: 100})
+
+	_, res, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": []string{"https://b.com"}})
+	assert.NotNil(t, err)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": []string{"https://a.com"}})
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	_, res, err = websocket.DefaultDialer.Dial(url, nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+
+	// an idle connection is closed
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "%v", err)
+
+	// the connection slot is released
+	assert.Eventually(t, func() bool {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+
+		if err != nil {
+			return false
+		}
+
+		conn.Close()
+		return true
+	}, time.Second, 10*time.Millisecond)
+}